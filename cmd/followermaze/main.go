@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/simulator"
+)
+
+//Command line front end for the follower-maze simulator
+//Defaults can be set with the same environment variables the original jar used
+//(totalEvents, concurrencyLevel, randomSeed, maxEventSourceBatchSize,
+//eventListenerPort, clientListenerPort and timeout)
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func main() {
+	conf := simulator.DefaultConfig()
+	host := flag.String("host", "localhost", "Host the server is running on")
+	eventPort := flag.Int("eventListenerPort", envInt("eventListenerPort", 9090), "Port the server listens for events on")
+	clientPort := flag.Int("clientListenerPort", envInt("clientListenerPort", 9099), "Port the server listens for user clients on")
+	flag.IntVar(&conf.TotalEvents, "totalEvents", envInt("totalEvents", conf.TotalEvents), "Number of events to send")
+	flag.IntVar(&conf.Users, "concurrencyLevel", envInt("concurrencyLevel", conf.Users), "Number of user clients to connect")
+	seed := flag.Int("randomSeed", envInt("randomSeed", int(conf.Seed)), "Seed for the generated events")
+	flag.IntVar(&conf.MaxBatch, "maxEventSourceBatchSize", envInt("maxEventSourceBatchSize", conf.MaxBatch), "Events are shuffled within batches of this size")
+	flag.IntVar(&conf.FirstSequence, "sequenceNumber", envInt("sequenceNumber", conf.FirstSequence), "Sequence number of the first event")
+	timeout := flag.Int("timeout", envInt("timeout", int(conf.Timeout/time.Millisecond)), "Milliseconds to wait for every notification")
+	flag.Parse()
+
+	conf.EventAddr = *host + ":" + strconv.Itoa(*eventPort)
+	conf.UserAddr = *host + ":" + strconv.Itoa(*clientPort)
+	conf.Seed = int64(*seed)
+	conf.Timeout = time.Duration(*timeout) * time.Millisecond
+
+	fmt.Println("Sending", conf.TotalEvents, "events to", conf.EventAddr, "with", conf.Users, "user clients on", conf.UserAddr)
+	result, err := simulator.Run(conf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(result.Events, "events,", result.Notifications, "notifications in", result.Elapsed)
+	fmt.Println("ALL NOTIFICATIONS RECEIVED")
+}
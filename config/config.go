@@ -1,38 +1,234 @@
 package config
 
 import (
-	"encoding/json"
-	"os"
+	"reflect"
+	"time"
 
 	"github.com/sahilahmadlone/MessagingSocketServer/logger"
 )
 
 //ServerConfig struct holds basic configurations
-//These can be set by passing arguments in to the commandline
-//in the form of `logLevel=DEBUG`
-//All configurations passed by commandline must be space delimited
-//If no commandline arguments are passed, default configs are used
+//These can be set in conf.json, by environment variables or by passing
+//flags in the form of `--logLevel=DEBUG` on the commandline, see Load
+//Settings that aren't set anywhere keep their built-in defaults
 type ServerConfig struct {
 	LogLevel           string
 	EventListenerPort  int
 	ClientListenerPort int
 	SequenceNumber     int
+	//Log output format, "text" or "json"
+	LogFormat string
+	//Where log messages are written, see logger.SinkConfig
+	LogSinks []logger.SinkConfig
+	//Layout of timestamps in the text log format, see time.Format
+	LogTimeFormat string
+	//Time zone of log timestamps, "local" or "utc"
+	LogTimeZone string
+	//Number of sub-second digits of log timestamps, 0 to 9
+	LogTimePrecision int
+	//"wall" for the time of day or "elapsed" for the time since startup
+	LogTimeMode string
+	//Number of messages buffered for a background writer, zero logs synchronously
+	LogBufferSize int
+	//What to do when the log buffer is full: "block", "drop" or "sample"
+	LogOverflowPolicy string
+	//Messages logged per call site and interval before sampling, zero disables rate limiting
+	LogRateLimitFirst int
+	//Once over the limit only one in this many messages of a call site is logged
+	LogRateLimitThereafter int
+	//Length of a rate limiting interval, suppressed counts are logged at its end
+	LogRateLimitIntervalMs int
+	//Directory for durable server state, persistence is disabled when empty
+	DataDir string
+	//Maximum size of a single event log segment in bytes
+	WalSegmentBytes int64
+	//Fsync the event log after every appended event
+	WalSync bool
+	//How often the follower graph and other file-backed stores are snapshotted,
+	//zero only snapshots them on shutdown
+	FollowerSnapshotIntervalMs int
+	//What to do when a sequence number never arrives:
+	//"wait", "skip-timeout", "skip-buffer" or "fail"
+	GapPolicy string
+	//How long a gap may stay open for "skip-timeout" and "fail"
+	GapTimeoutMs int
+	//Number of buffered events that triggers a skip for "skip-buffer"
+	GapMaxBuffered int
+	//How far ahead of the next expected sequence number events are buffered
+	//before event sources stop being read, zero means unbounded
+	MaxReorderWindow int
+	//Number of goroutines fanning dispatched events out to users, users are split between them by ID
+	//One fans out on the dispatcher goroutine itself, zero uses one per CPU
+	DispatchShards int
+	//Number of events queued per user before the slow consumer policy kicks in
+	UserQueueDepth int
+	//Deadline for a single write to a user client, zero disables it
+	UserWriteTimeoutMs int
+	//Maximum number of queued events combined into a single write to a user client
+	UserWriteBatchSize int
+	//How long a user's writer waits for more events to fill a batch,
+	//zero writes as soon as the queue is empty
+	UserFlushIntervalMs int
+	//What to do when a user's queue is full:
+	//"disconnect", "drop-oldest", "drop-newest" or "block"
+	SlowConsumerPolicy string
+	//Maximum number of simultaneous sessions per user ID, zero means unlimited
+	MaxSessionsPerUser int
+	//What to do when a user exceeds the session limit:
+	//"evict-oldest" or "reject-new"
+	SessionEvictionPolicy string
+	//Number of undelivered events kept per offline user, zero disables the mailbox
+	MailboxSize int
+	//How long undelivered events are kept, zero keeps them until the box overflows
+	MailboxMaxAgeMs int
+	//Number of dispatched events retained for clients resuming with
+	//"userId|lastSeenSequence", zero disables the history
+	HistorySize int
+	//Address the admin HTTP API binds to, empty binds every interface
+	AdminListenerAddress string
+	//Port of the admin HTTP API, zero disables it
+	AdminListenerPort int
+	//How long a graceful shutdown waits for queued events to reach users
+	ShutdownTimeoutMs int
+}
+
+//Returns the built-in defaults, matching the shipped conf.json
+//Used when a server is embedded without a configuration file
+func Defaults() ServerConfig {
+	return ServerConfig{
+		LogLevel:                   "INFO",
+		LogFormat:                  "text",
+		LogSinks:                   []logger.SinkConfig{{Type: "stdout"}},
+		LogTimeFormat:              logger.DefaultTimeFormat,
+		LogTimeZone:                "local",
+		LogTimeMode:                "wall",
+		LogOverflowPolicy:          "block",
+		LogRateLimitFirst:          100,
+		LogRateLimitThereafter:     1000,
+		LogRateLimitIntervalMs:     1000,
+		EventListenerPort:          9090,
+		ClientListenerPort:         9099,
+		SequenceNumber:             1,
+		WalSegmentBytes:            64 << 20,
+		FollowerSnapshotIntervalMs: 60000,
+		GapPolicy:                  "wait",
+		GapTimeoutMs:               5000,
+		GapMaxBuffered:             10000,
+		MaxReorderWindow:           100000,
+		UserQueueDepth:             10000,
+		UserWriteTimeoutMs:         5000,
+		UserWriteBatchSize:         64,
+		SlowConsumerPolicy:         "disconnect",
+		SessionEvictionPolicy:      "evict-oldest",
+		MailboxMaxAgeMs:            3600000,
+		HistorySize:                10000,
+		AdminListenerAddress:       "127.0.0.1",
+		ShutdownTimeoutMs:          5000,
+	}
 }
 
 //Loads default configuration for the Server from conf.json
 //In a production environment such configuration would likely be done
 //using feature flags or a puppet-like tool to avoid code changes upon config update.
+//Problems with the file are logged, Load also applies environment variables,
+//flags and validation and reports problems instead
 func ServerDefaultConfig(path string) *ServerConfig {
 	var conf ServerConfig = ServerConfig{}
-	file, err := os.Open(path + "conf.json")
-	if err != nil {
-		logger.Error("FileError", err)
-	}
-	decoder := json.NewDecoder(file)
-	decErr := decoder.Decode(&conf)
-	if decErr != nil {
-		logger.Error("Decode Error ", err)
+	if err := loadFile(&conf, path+"conf.json"); err != nil {
+		logger.Error("Unable to load configuration ", err)
 	}
-	logger.SetLevel(conf.LogLevel)
+	ConfigureLogger(conf)
 	return &conf
 }
+
+//Applies the logging settings of conf to the logger package
+//Settings left empty keep the logger's current value
+func ConfigureLogger(conf ServerConfig) {
+	logger.SetLevel(conf.LogLevel)
+	if conf.LogFormat != "" {
+		logger.SetFormat(conf.LogFormat)
+	}
+	if conf.LogTimeFormat != "" {
+		logger.SetTimeFormat(conf.LogTimeFormat)
+	}
+	if conf.LogTimeZone != "" {
+		if err := logger.SetTimeZone(conf.LogTimeZone); err != nil {
+			logger.Error("Invalid log time zone ", err)
+		}
+	}
+	if err := logger.SetTimePrecision(conf.LogTimePrecision); err != nil {
+		logger.Error("Invalid log time precision ", err)
+	}
+	if conf.LogTimeMode != "" {
+		if err := logger.SetTimeMode(conf.LogTimeMode); err != nil {
+			logger.Error("Invalid log time mode ", err)
+		}
+	}
+	if len(conf.LogSinks) > 0 {
+		if err := logger.Configure(conf.LogSinks); err != nil {
+			logger.Error("Unable to configure log sinks ", err)
+		}
+	}
+	overflow := conf.LogOverflowPolicy
+	if overflow == "" {
+		overflow = "block"
+	}
+	if err := logger.SetAsync(conf.LogBufferSize, overflow); err != nil {
+		logger.Error("Invalid log buffer configuration ", err)
+	}
+	interval := time.Duration(conf.LogRateLimitIntervalMs) * time.Millisecond
+	if err := logger.SetRateLimit(conf.LogRateLimitFirst, conf.LogRateLimitThereafter, interval); err != nil {
+		logger.Error("Invalid log rate limit configuration ", err)
+	}
+}
+
+//Applies the logging settings that differ between the running configuration and next,
+//used when reloading so the sinks, the async pipeline, the rate limiter and the origin
+//of elapsed timestamps are only rebuilt when their own settings changed
+func ReconfigureLogger(running ServerConfig, next ServerConfig) {
+	if next.LogLevel != running.LogLevel {
+		logger.SetLevel(next.LogLevel)
+	}
+	if next.LogFormat != running.LogFormat && next.LogFormat != "" {
+		logger.SetFormat(next.LogFormat)
+	}
+	if next.LogTimeFormat != running.LogTimeFormat && next.LogTimeFormat != "" {
+		logger.SetTimeFormat(next.LogTimeFormat)
+	}
+	if next.LogTimeZone != running.LogTimeZone && next.LogTimeZone != "" {
+		if err := logger.SetTimeZone(next.LogTimeZone); err != nil {
+			logger.Error("Invalid log time zone ", err)
+		}
+	}
+	if next.LogTimePrecision != running.LogTimePrecision {
+		if err := logger.SetTimePrecision(next.LogTimePrecision); err != nil {
+			logger.Error("Invalid log time precision ", err)
+		}
+	}
+	if next.LogTimeMode != running.LogTimeMode && next.LogTimeMode != "" {
+		if err := logger.SetTimeMode(next.LogTimeMode); err != nil {
+			logger.Error("Invalid log time mode ", err)
+		}
+	}
+	if !reflect.DeepEqual(next.LogSinks, running.LogSinks) && len(next.LogSinks) > 0 {
+		if err := logger.Configure(next.LogSinks); err != nil {
+			logger.Error("Unable to configure log sinks ", err)
+		}
+	}
+	if next.LogBufferSize != running.LogBufferSize || next.LogOverflowPolicy != running.LogOverflowPolicy {
+		overflow := next.LogOverflowPolicy
+		if overflow == "" {
+			overflow = "block"
+		}
+		if err := logger.SetAsync(next.LogBufferSize, overflow); err != nil {
+			logger.Error("Invalid log buffer configuration ", err)
+		}
+	}
+	if next.LogRateLimitFirst != running.LogRateLimitFirst || next.LogRateLimitThereafter != running.LogRateLimitThereafter ||
+		next.LogRateLimitIntervalMs != running.LogRateLimitIntervalMs {
+		interval := time.Duration(next.LogRateLimitIntervalMs) * time.Millisecond
+		if err := logger.SetRateLimit(next.LogRateLimitFirst, next.LogRateLimitThereafter, interval); err != nil {
+			logger.Error("Invalid log rate limit configuration ", err)
+		}
+	}
+}
@@ -1,22 +1,129 @@
 package config_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"github.com/sahilahmadlone/MessagingSocketServer/config"
+	"github.com/sahilahmadlone/MessagingSocketServer/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServerConfigShouldEqual(t *testing.T) {
 	conf := config.ServerDefaultConfig("./")
-	msc := config.ServerConfig{LogLevel: "INFO", ClientListenerPort: 9099, EventListenerPort: 9090, SequenceNumber: 1}
+	msc := config.ServerConfig{LogLevel: "INFO", LogFormat: "text", LogSinks: []logger.SinkConfig{{Type: "stdout"}}, LogTimeFormat: "2006/01/02 - 15:04:05", LogTimeZone: "local", LogTimeMode: "wall", LogOverflowPolicy: "block", LogRateLimitFirst: 100, LogRateLimitThereafter: 1000, LogRateLimitIntervalMs: 1000, ClientListenerPort: 9099, EventListenerPort: 9090, SequenceNumber: 1, WalSegmentBytes: 67108864, FollowerSnapshotIntervalMs: 60000, GapPolicy: "wait", GapTimeoutMs: 5000, GapMaxBuffered: 10000, MaxReorderWindow: 100000, UserQueueDepth: 10000, UserWriteTimeoutMs: 5000, UserWriteBatchSize: 64, SlowConsumerPolicy: "disconnect", SessionEvictionPolicy: "evict-oldest", MailboxMaxAgeMs: 3600000, HistorySize: 10000, AdminListenerAddress: "127.0.0.1", ShutdownTimeoutMs: 5000}
 	if !reflect.DeepEqual(*conf, msc) {
 		t.Error("Configurations are NOT equal")
 	}
 }
 func TestServerConfigShouldNotEqual(t *testing.T) {
 	conf := config.ServerDefaultConfig("./")
-	msc := config.ServerConfig{LogLevel: "INFO", ClientListenerPort: 9090, EventListenerPort: 9090, SequenceNumber: 1}
+	msc := config.ServerConfig{LogLevel: "INFO", LogFormat: "text", LogSinks: []logger.SinkConfig{{Type: "stdout"}}, LogTimeFormat: "2006/01/02 - 15:04:05", LogTimeZone: "local", LogTimeMode: "wall", LogOverflowPolicy: "block", LogRateLimitFirst: 100, LogRateLimitThereafter: 1000, LogRateLimitIntervalMs: 1000, ClientListenerPort: 9090, EventListenerPort: 9090, SequenceNumber: 1, WalSegmentBytes: 67108864, FollowerSnapshotIntervalMs: 60000, GapPolicy: "wait", GapTimeoutMs: 5000, GapMaxBuffered: 10000, MaxReorderWindow: 100000, UserQueueDepth: 10000, UserWriteTimeoutMs: 5000, UserWriteBatchSize: 64, SlowConsumerPolicy: "disconnect", SessionEvictionPolicy: "evict-oldest", MailboxMaxAgeMs: 3600000, HistorySize: 10000, AdminListenerAddress: "127.0.0.1", ShutdownTimeoutMs: 5000}
 	if reflect.DeepEqual(*conf, msc) {
 		t.Error("Configurations are equal and should NOT be")
 	}
 }
+
+func TestServerConfigDefaultsMatchFile(t *testing.T) {
+	conf := config.ServerDefaultConfig("./")
+	if !reflect.DeepEqual(*conf, config.Defaults()) {
+		t.Error("Built-in defaults don't match conf.json ", config.Defaults())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.json")
+	ioutil.WriteFile(path, []byte(`{"eventListenerPort": 7000, "clientListenerPort": 7001, "logLevel": "DEBUG", "historySize": 5}`), 0644)
+
+	env := []string{"HOME=/root", "clientListenerPort=7011", "eventListenerPort=7010", "historySize=50"}
+	args := []string{"--config=" + path, "--eventListenerPort", "7020", "--walSync", `--logSinks=[{"type":"stderr"}]`}
+	conf, err := config.Load(args, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.EventListenerPort != 7020 || conf.ClientListenerPort != 7011 || conf.HistorySize != 50 {
+		t.Error("Expected flags over environment over file, got ", conf.EventListenerPort, " ", conf.ClientListenerPort, " ", conf.HistorySize)
+	}
+	if conf.LogLevel != "DEBUG" || conf.GapPolicy != "wait" || !conf.WalSync {
+		t.Error("Expected file values over defaults, got ", conf.LogLevel, " ", conf.GapPolicy, " ", conf.WalSync)
+	}
+	if !reflect.DeepEqual(conf.LogSinks, []logger.SinkConfig{{Type: "stderr"}}) {
+		t.Error("Expected the sinks from the flag, got ", conf.LogSinks)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	args := []string{"--eventListenerPort=abc", "--clientListenerPort=70000", "--adminListenerPort=9090", "--dispatchShards=-2", "stray"}
+	_, err := config.Load(args, []string{"logLevel=LOUD", "walSync=maybe"})
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 7 {
+		t.Fatal("Expected 7 problems, got ", err)
+	}
+	for _, want := range []string{"stray", "flag --eventListenerPort", "environment variable walSync", "out of range", "adminListenerPort 9090", "dispatchShards -2", "INVALID LOG LEVEL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be reported in %v", want, err)
+		}
+	}
+}
+
+func TestLoadReportsBadLogSettings(t *testing.T) {
+	environ := []string{"logTimeZone=mars", "logTimePrecision=12", "logTimeMode=sundial", "logOverflowPolicy=explode"}
+	_, err := config.Load(nil, environ)
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 4 {
+		t.Fatal("Expected 4 problems, got ", err)
+	}
+	for _, want := range []string{"INVALID TIME ZONE", "INVALID TIME PRECISION", "INVALID TIME MODE", "INVALID LOG OVERFLOW POLICY"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be reported in %v", want, err)
+		}
+	}
+}
+
+func TestLoadDefaultsAndMissingFile(t *testing.T) {
+	conf, err := config.Load(nil, nil)
+	if err != nil || !reflect.DeepEqual(conf, config.Defaults()) {
+		t.Error("Expected the built-in defaults without a configuration file ", err)
+	}
+	if _, err := config.Load([]string{"--config=missing.json"}, nil); err == nil {
+		t.Error("An explicitly passed configuration file must exist")
+	}
+	if _, err := config.Load([]string{"--clientListenerPort=9090"}, nil); err == nil || !strings.Contains(err.Error(), "both 9090") {
+		t.Error("Expected a port collision, got ", err)
+	}
+	if _, err := config.Load([]string{"--help"}, nil); err != flag.ErrHelp {
+		t.Error("Expected flag.ErrHelp, got ", err)
+	}
+}
+
+func TestReconfigureLoggerOnlyAppliesChanges(t *testing.T) {
+	running := config.Defaults()
+	running.LogFormat = "json"
+	running.LogTimeMode = "elapsed"
+	config.ConfigureLogger(running)
+	defer config.ConfigureLogger(config.Defaults())
+	var output bytes.Buffer
+	logger.SetSinks(logger.Sink{Writer: &output})
+	time.Sleep(50 * time.Millisecond)
+
+	next := running
+	next.LogLevel = "DEBUG"
+	config.ReconfigureLogger(running, next)
+	logger.Debug("after reload")
+	logger.Flush()
+	var line map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &line); err != nil {
+		t.Fatal("Expected the unchanged sink to get the debug message ", output.String())
+	}
+	if elapsed, _ := line["elapsed"].(float64); elapsed < 0.05 {
+		t.Error("Expected the elapsed origin to survive the reload, got ", line["elapsed"])
+	}
+}
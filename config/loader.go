@@ -0,0 +1,267 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/logger"
+)
+
+//Configuration file read by Load unless --config says otherwise
+const DefaultConfigPath = "config/conf.json"
+
+//Errors collects every problem found while loading a configuration
+type Errors []error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//Loads the server configuration in layers, each overriding the one before:
+//built-in defaults, the configuration file, environment variables and flags
+//Every setting is named like its conf.json key, e.g. the environment variable
+//eventListenerPort=9090 or the flag --eventListenerPort=9090
+//The file is DefaultConfigPath unless --config is passed, a missing default file is skipped
+//All problems, including failed validation, are reported together in an Errors
+//flag.ErrHelp is returned for --help, see Usage
+func Load(args []string, environ []string) (ServerConfig, error) {
+	var errs Errors
+	flags := make(map[string]string)
+	fs, path := newFlagSet(flags)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return ServerConfig{}, err
+		}
+		errs = append(errs, err)
+	}
+	if fs.NArg() > 0 {
+		errs = append(errs, fmt.Errorf("unexpected argument %q, settings are passed as --name=value", fs.Arg(0)))
+	}
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+
+	conf := Defaults()
+	if err := loadFile(&conf, *path); err != nil && (explicit || !os.IsNotExist(err)) {
+		errs = append(errs, err)
+	}
+	errs = append(errs, applySettings(&conf, parseEnviron(environ), "environment variable ")...)
+	errs = append(errs, applySettings(&conf, flags, "flag --")...)
+	if err := Validate(conf); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if len(errs) > 0 {
+		return conf, errs
+	}
+	return conf, nil
+}
+
+//Writes the flags Load accepts to w
+func Usage(w io.Writer) {
+	fs, _ := newFlagSet(make(map[string]string))
+	fs.SetOutput(w)
+	fmt.Fprintln(w, "Usage: MessagingSocketServer [--config=path] [--name=value ...]")
+	fs.PrintDefaults()
+}
+
+//Checks of settings that are parsed by the packages using them, see AddCheck
+var checks []func(conf ServerConfig) error
+
+//Adds a check Validate runs on every configuration
+//Packages interpreting settings themselves, like the server's policies,
+//add their checks from an init function so Load reports bad values up front
+func AddCheck(check func(conf ServerConfig) error) {
+	checks = append(checks, check)
+}
+
+//Checks that ports are in range and don't collide, that the log settings are known
+//and runs the checks added with AddCheck
+func Validate(conf ServerConfig) error {
+	var errs Errors
+	ports := map[string]int{
+		"eventListenerPort":  conf.EventListenerPort,
+		"clientListenerPort": conf.ClientListenerPort,
+	}
+	if conf.AdminListenerPort != 0 {
+		ports["adminListenerPort"] = conf.AdminListenerPort
+	}
+	for _, name := range []string{"eventListenerPort", "clientListenerPort", "adminListenerPort"} {
+		port, ok := ports[name]
+		if ok && (port < 1 || port > 65535) {
+			errs = append(errs, fmt.Errorf("%s %d is out of range 1-65535", name, port))
+		}
+	}
+	if conf.EventListenerPort == conf.ClientListenerPort {
+		errs = append(errs, fmt.Errorf("eventListenerPort and clientListenerPort are both %d", conf.EventListenerPort))
+	}
+	if conf.AdminListenerPort != 0 && (conf.AdminListenerPort == conf.EventListenerPort || conf.AdminListenerPort == conf.ClientListenerPort) {
+		errs = append(errs, fmt.Errorf("adminListenerPort %d is already used by the event or client listener", conf.AdminListenerPort))
+	}
+	if conf.DispatchShards < 0 {
+		errs = append(errs, fmt.Errorf("dispatchShards %d is negative", conf.DispatchShards))
+	}
+	if err := logger.CheckLevel(conf.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.LogFormat != "" {
+		if err := logger.CheckFormat(conf.LogFormat); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.LogTimeZone != "" {
+		if err := logger.CheckTimeZone(conf.LogTimeZone); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := logger.CheckTimePrecision(conf.LogTimePrecision); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.LogTimeMode != "" {
+		if err := logger.CheckTimeMode(conf.LogTimeMode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.LogOverflowPolicy != "" {
+		if err := logger.CheckOverflowPolicy(conf.LogOverflowPolicy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, check := range checks {
+		if err := check(conf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//Decodes the JSON file at path over conf, keys missing from the file keep their value
+func loadFile(conf *ServerConfig, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(conf); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+//settingFlag records the raw value of a flag, values are applied after the file and environment
+type settingFlag struct {
+	name   string
+	isBool bool
+	values map[string]string
+}
+
+func (sf settingFlag) String() string {
+	return ""
+}
+
+func (sf settingFlag) Set(value string) error {
+	sf.values[sf.name] = value
+	return nil
+}
+
+func (sf settingFlag) IsBoolFlag() bool {
+	return sf.isBool
+}
+
+//Creates a flag for every setting plus --config
+func newFlagSet(values map[string]string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("MessagingSocketServer", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	path := fs.String("config", DefaultConfigPath, "configuration file")
+	defaults := reflect.ValueOf(Defaults())
+	for i := 0; i < defaults.NumField(); i++ {
+		name := settingName(defaults.Type().Field(i).Name)
+		field := defaults.Field(i)
+		usage := "overrides " + name
+		if field.Kind() != reflect.Slice {
+			usage += fmt.Sprintf(" (default %v)", field.Interface())
+		} else {
+			usage += " as JSON"
+		}
+		fs.Var(settingFlag{name, field.Kind() == reflect.Bool, values}, name, usage)
+	}
+	return fs, path
+}
+
+//Splits "name=value" entries, as returned by os.Environ
+func parseEnviron(environ []string) map[string]string {
+	env := make(map[string]string)
+	for _, entry := range environ {
+		if i := strings.Index(entry, "="); i > 0 {
+			env[entry[:i]] = entry[i+1:]
+		}
+	}
+	return env
+}
+
+//Sets every field of conf named in values, source describes where the values came from
+func applySettings(conf *ServerConfig, values map[string]string, source string) Errors {
+	var errs Errors
+	fields := reflect.ValueOf(conf).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		name := settingName(fields.Type().Field(i).Name)
+		raw, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := setField(fields.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s%s: %v", raw, source, name, err))
+		}
+	}
+	return errs
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		field.SetBool(b)
+	default:
+		decoded := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(raw), decoded.Interface()); err != nil {
+			return err
+		}
+		field.Set(decoded.Elem())
+	}
+	return nil
+}
+
+//Returns the conf.json key of a ServerConfig field, e.g. "logLevel" for LogLevel
+func settingName(field string) string {
+	r, size := utf8.DecodeRuneInString(field)
+	return string(unicode.ToLower(r)) + field[size:]
+}
@@ -1,3 +1,3 @@
 #! /bin/bash
 
-time java -server -Xmx1G -jar ./follower-maze-2.0.jar
+time go run ./cmd/followermaze "$@"
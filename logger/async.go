@@ -0,0 +1,142 @@
+package logger
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//What to do with a message when the asynchronous buffer is full
+const (
+	//Wait for the writer to make room
+	overflowBlock = iota
+	//Discard the message
+	overflowDrop
+	//Keep one in every overflowSampleRate messages, waiting for room, discard the rest
+	overflowSample
+)
+
+const overflowSampleRate = 100
+
+var (
+	overflows = map[string]int{
+		"BLOCK":  overflowBlock,
+		"DROP":   overflowDrop,
+		"SAMPLE": overflowSample,
+	}
+	//Guards pipeline, held for reading while messages are queued
+	asyncMutex sync.RWMutex
+	pipeline   *asyncPipeline
+	dropped    int64
+	overflowed uint64
+)
+
+//asyncPipeline hands messages to a background writer through a bounded buffer
+//so logging never waits on the mutex or the sinks
+type asyncPipeline struct {
+	queue    chan *logMessage
+	overflow int
+	stopped  chan struct{}
+}
+
+//Switches to asynchronous logging with a buffer of size messages
+//overflow is what happens when the buffer is full: "BLOCK" waits for room,
+//"DROP" discards the message and "SAMPLE" keeps one in every 100 messages
+//Discarded messages are counted by Dropped
+//A size of 0 flushes the buffer and goes back to writing synchronously
+//Message arguments are formatted by the writer, so they shouldn't be changed after logging them
+func SetAsync(size int, overflow string) error {
+	if size < 0 {
+		return errors.New("INVALID LOG BUFFER SIZE: " + strconv.Itoa(size))
+	}
+	policy, ok := overflows[strings.ToUpper(overflow)]
+	if !ok {
+		return errors.New("INVALID LOG OVERFLOW POLICY: " + overflow)
+	}
+	var next *asyncPipeline
+	if size > 0 {
+		next = &asyncPipeline{make(chan *logMessage, size), policy, make(chan struct{})}
+		go next.run()
+	}
+	asyncMutex.Lock()
+	previous := pipeline
+	pipeline = next
+	asyncMutex.Unlock()
+	if previous != nil {
+		close(previous.queue)
+		<-previous.stopped
+	}
+	return nil
+}
+
+//Returns an error if overflow isn't a policy SetAsync accepts
+func CheckOverflowPolicy(overflow string) error {
+	if _, ok := overflows[strings.ToUpper(overflow)]; !ok {
+		return errors.New("INVALID LOG OVERFLOW POLICY: " + overflow)
+	}
+	return nil
+}
+
+//Waits until every message logged before the call has been written
+//Does nothing when logging synchronously
+func Flush() {
+	asyncMutex.RLock()
+	if pipeline == nil {
+		asyncMutex.RUnlock()
+		return
+	}
+	flushed := make(chan struct{})
+	pipeline.queue <- &logMessage{flushed: flushed}
+	asyncMutex.RUnlock()
+	<-flushed
+}
+
+//Number of messages discarded because the asynchronous buffer was full
+func Dropped() int64 {
+	return atomic.LoadInt64(&dropped)
+}
+
+//Queues the message for the background writer
+//Returns false when logging synchronously
+func enqueue(lm *logMessage) bool {
+	asyncMutex.RLock()
+	defer asyncMutex.RUnlock()
+	if pipeline == nil {
+		return false
+	}
+	pipeline.push(lm)
+	return true
+}
+
+func (ap *asyncPipeline) push(lm *logMessage) {
+	select {
+	case ap.queue <- lm:
+		return
+	default:
+	}
+	switch ap.overflow {
+	case overflowBlock:
+		ap.queue <- lm
+	case overflowSample:
+		if atomic.AddUint64(&overflowed, 1)%overflowSampleRate == 0 {
+			ap.queue <- lm
+			return
+		}
+		atomic.AddInt64(&dropped, 1)
+	default:
+		atomic.AddInt64(&dropped, 1)
+	}
+}
+
+func (ap *asyncPipeline) run() {
+	defer close(ap.stopped)
+	for lm := range ap.queue {
+		if lm.flushed != nil {
+			close(lm.flushed)
+			continue
+		}
+		writeLogMessage(lm)
+	}
+}
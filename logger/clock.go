@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Default layout of timestamps in the text format
+const DefaultTimeFormat = "2006/01/02 - 15:04:05"
+
+var (
+	//Print timestamps in UTC instead of the local time zone
+	utcTime bool
+	//Number of sub-second digits printed, 0 to 9
+	timePrecision int
+	//Print the time elapsed since elapsedStart instead of the wall clock
+	elapsedTime  bool
+	elapsedStart time.Time
+)
+
+//Sets the time zone of timestamps, "LOCAL" (default) or "UTC"
+func SetTimeZone(zone string) error {
+	switch strings.ToUpper(zone) {
+	case "LOCAL":
+		setLocked(func() { utcTime = false })
+	case "UTC":
+		setLocked(func() { utcTime = true })
+	default:
+		return errors.New("INVALID TIME ZONE: " + zone)
+	}
+	return nil
+}
+
+//Returns an error if zone isn't a time zone SetTimeZone accepts
+func CheckTimeZone(zone string) error {
+	switch strings.ToUpper(zone) {
+	case "LOCAL", "UTC":
+		return nil
+	}
+	return errors.New("INVALID TIME ZONE: " + zone)
+}
+
+//Sets the number of sub-second digits of timestamps, 0 (default) to 9 for nanoseconds
+//The digits are added to the seconds of the layout unless it already has some
+func SetTimePrecision(digits int) error {
+	if err := CheckTimePrecision(digits); err != nil {
+		return err
+	}
+	setLocked(func() { timePrecision = digits })
+	return nil
+}
+
+//Returns an error if digits is outside of 0 to 9
+func CheckTimePrecision(digits int) error {
+	if digits < 0 || digits > 9 {
+		return errors.New("INVALID TIME PRECISION: " + strconv.Itoa(digits))
+	}
+	return nil
+}
+
+//Returns an error if mode isn't a time mode SetTimeMode accepts
+func CheckTimeMode(mode string) error {
+	switch strings.ToUpper(mode) {
+	case "WALL", "ELAPSED":
+		return nil
+	}
+	return errors.New("INVALID TIME MODE: " + mode)
+}
+
+//Sets what timestamps show, "WALL" (default) for the time of day or
+//"ELAPSED" for the time since this call, measured on the monotonic clock
+//Elapsed time is handy for benchmarking runs, e.g. "12.345s" with a precision of 3
+func SetTimeMode(mode string) error {
+	switch strings.ToUpper(mode) {
+	case "WALL":
+		setLocked(func() { elapsedTime = false })
+	case "ELAPSED":
+		setLocked(func() {
+			elapsedTime = true
+			elapsedStart = time.Now()
+		})
+	default:
+		return errors.New("INVALID TIME MODE: " + mode)
+	}
+	return nil
+}
+
+//Settings are read while writing messages, so they are changed under the mutex
+func setLocked(set func()) {
+	mutex.Lock()
+	set()
+	mutex.Unlock()
+}
+
+//Returns the timestamp of the text format
+func textTime(now time.Time) string {
+	if elapsedTime {
+		return elapsed(now)
+	}
+	return zoned(now).Format(withPrecision(timeFormat, "05"))
+}
+
+//Returns the timestamp key and value of the JSON format, RFC3339 time
+//or the elapsed seconds as a number
+func jsonTime(now time.Time) (string, interface{}) {
+	if elapsedTime {
+		return "elapsed", now.Sub(elapsedStart).Seconds()
+	}
+	return "time", zoned(now).Format(withPrecision(time.RFC3339, "05"))
+}
+
+func elapsed(now time.Time) string {
+	return strconv.FormatFloat(now.Sub(elapsedStart).Seconds(), 'f', timePrecision, 64) + "s"
+}
+
+func zoned(now time.Time) time.Time {
+	if utcTime {
+		return now.UTC()
+	}
+	return now
+}
+
+//Adds the configured number of sub-second digits after the seconds of layout
+func withPrecision(layout string, seconds string) string {
+	if timePrecision == 0 || strings.Contains(layout, seconds+".0") || strings.Contains(layout, seconds+".9") {
+		return layout
+	}
+	return strings.Replace(layout, seconds, seconds+"."+strings.Repeat("0", timePrecision), 1)
+}
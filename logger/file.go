@@ -0,0 +1,241 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Suffix format of rotated files, sorts in rotation order
+const rotatedTimeFormat = "20060102-150405.000000"
+
+//How long a file that failed to rotate is written to before rotating is tried again
+const rotateRetryInterval = time.Minute
+
+//FileOptions configures rotation of a RotatingFile
+type FileOptions struct {
+	//Size in bytes after which the file is rotated, zero disables it
+	MaxBytes int64
+	//Age after which the file is rotated, zero disables it
+	MaxAge time.Duration
+	//Number of rotated files kept, zero keeps all of them
+	MaxBackups int
+	//Gzip rotated files in the background
+	Compress bool
+}
+
+//RotatingFile is a log file that is moved aside to "<path>.<time>" once it
+//grows past MaxBytes or gets older than MaxAge, and reopened empty
+//Safe for concurrent use
+type RotatingFile struct {
+	mutex  sync.Mutex
+	path   string
+	opts   FileOptions
+	file   *os.File
+	size   int64
+	opened time.Time
+	//Rotation isn't tried again before this after it failed
+	retry      time.Time
+	background sync.WaitGroup
+}
+
+//Opens (or appends to) the log file at path, creating its directory if needed
+func OpenRotatingFile(path string, opts FileOptions) (*RotatingFile, error) {
+	if path == "" {
+		return nil, errors.New("INVALID LOG FILE: empty path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rf := &RotatingFile{path: path, opts: opts}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+//Writes p, rotating the file first if p would take it past MaxBytes
+//or the file is older than MaxAge
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.due(int64(len(p))) && time.Now().After(rf.retry) {
+		if err := rf.rotate(); err != nil {
+			//Keep logging to the current file and report the failure through every sink
+			rf.retry = time.Now().Add(rotateRetryInterval)
+			rf.background.Add(1)
+			go func() {
+				defer rf.background.Done()
+				Output(1, "ERROR", "Unable to rotate log file ", rf.path, " ", err)
+			}()
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) due(next int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.opts.MaxBytes > 0 && rf.size+next > rf.opts.MaxBytes {
+		return true
+	}
+	return rf.opts.MaxAge > 0 && time.Since(rf.opened) >= rf.opts.MaxAge
+}
+
+//Moves the current file aside and reopens an empty one
+//Compression and pruning of old files happen in the background
+//On failure the current file stays open, at its original path if possible
+func (rf *RotatingFile) rotate() error {
+	current := rf.file
+	rotated := rf.path + "." + time.Now().Format(rotatedTimeFormat)
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = rf.path + "." + time.Now().Format(rotatedTimeFormat) + "." + strconv.Itoa(i)
+	}
+	if err := os.Rename(rf.path, rotated); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		//The file was removed from under us, start a new one at its path
+		if err := rf.open(); err != nil {
+			return err
+		}
+		current.Close()
+		return nil
+	}
+	if err := rf.open(); err != nil {
+		os.Rename(rotated, rf.path)
+		return err
+	}
+	current.Close()
+	rf.background.Add(1)
+	go func() {
+		defer rf.background.Done()
+		if rf.opts.Compress {
+			if err := compressFile(rotated); err != nil {
+				Output(1, "ERROR", "Unable to compress rotated log file ", rotated, " ", err)
+			}
+		}
+		rf.prune()
+	}()
+	return nil
+}
+
+//Removes the oldest rotated files beyond MaxBackups
+func (rf *RotatingFile) prune() {
+	if rf.opts.MaxBackups <= 0 {
+		return
+	}
+	rotated := rf.rotated()
+	for len(rotated) > rf.opts.MaxBackups {
+		os.Remove(rotated[0])
+		os.Remove(rotated[0] + ".gz")
+		rotated = rotated[1:]
+	}
+}
+
+//Returns the rotated files, oldest first, without their ".gz" suffix
+func (rf *RotatingFile) rotated() []string {
+	matches, _ := filepath.Glob(rf.path + ".*")
+	seen := make(map[string]bool)
+	var rotated []string
+	for _, match := range matches {
+		name := strings.TrimSuffix(match, ".gz")
+		if strings.HasSuffix(name, ".tmp") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		rotated = append(rotated, name)
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+//Returns the paths of the rotated files, oldest first
+func (rf *RotatingFile) Rotated() []string {
+	rf.background.Wait()
+	var paths []string
+	for _, name := range rf.rotated() {
+		if exists(name + ".gz") {
+			name += ".gz"
+		}
+		paths = append(paths, name)
+	}
+	return paths
+}
+
+//Closes the file after waiting for background compression to finish
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	rf.mutex.Unlock()
+	rf.background.Wait()
+	return err
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//Gzips path to path.gz and removes path
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -1,17 +1,21 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //Since only errors are logged in std golang lib this is a custom logger
 //LoggingLevel can be altered in the conf.json or via commandline
+//Messages go to stdout unless other sinks are set with SetSinks or Configure
 
 var (
 	lls = map[string]int{
@@ -21,96 +25,238 @@ var (
 		"WARN":  3,
 		"ERROR": 4,
 	}
-	logLevel   int
+	formats = map[string]int{
+		"TEXT": textFormat,
+		"JSON": jsonFormat,
+	}
+	//Read without the mutex, changed atomically
+	logLevel   int32
+	logFormat  int
 	timeFormat string
 	mutex      *sync.Mutex
 )
 
+const (
+	//[ INFO ] - time -- file @ line  :  [message] key=value
+	textFormat = iota
+	//{"level":"INFO","time":"RFC3339","caller":"file:line","msg":"message","key":value}
+	//with "elapsed":seconds instead of "time" in the elapsed time mode
+	jsonFormat
+)
+
 //logMessage struct is created/printed during runtime when
 //one of the LogLeve() functions is called
-//Here the loglevel, file and line of caller (skips 3 levels), time, and message are called
+//Here the loglevel, file and line of caller, time, message and key/value fields are called
+//The caller is only resolved from pc when the message is written
 type logMessage struct {
-	m     []interface{}
-	file  string
-	lline int
-	level string
+	m      []interface{}
+	file   string
+	lline  int
+	level  string
+	fields []interface{}
+	pc     uintptr
+	time   time.Time
+	//Set on the marker Flush sends through the asynchronous pipeline
+	flushed chan struct{}
 }
 
-//Mutex is used for logging to stdOut
-//Prints log messages with all the info
+//Mutex is used for writing to the sinks
+//Prints log messages with all the info in the selected format
 func writeLogMessage(lm *logMessage) {
+	frame, _ := runtime.CallersFrames([]uintptr{lm.pc}).Next()
+	lm.file, lm.lline = filepath.Base(frame.File), frame.Line
 	mutex.Lock()
-	timeNow := time.Now().Format(timeFormat)
-	fmt.Println("[", lm.level, "] - ", timeNow, "--", lm.file, "@", lm.lline, " : ", lm.m)
+	now := lm.time
+	if logFormat == jsonFormat {
+		writeSinks(lm.level, encodeJSON(lm, now))
+	} else {
+		timeNow := textTime(now)
+		line := []interface{}{"[", lm.level, "] - ", timeNow, "--", lm.file, "@", lm.lline, " : ", lm.m}
+		for i := 0; i < len(lm.fields); i += 2 {
+			line = append(line, fmt.Sprint(lm.fields[i], "=", lm.fields[i+1]))
+		}
+		writeSinks(lm.level, []byte(fmt.Sprintln(line...)))
+	}
 	mutex.Unlock()
 }
 
-//Sets the LogLevel of the logger
+//Encodes the message as a single line JSON object
+//Fields keep their JSON type, values that can't be encoded are written as strings
+func encodeJSON(lm *logMessage, now time.Time) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"level":`)
+	writeJSONValue(&b, lm.level)
+	key, value := jsonTime(now)
+	b.WriteString(",")
+	writeJSONValue(&b, key)
+	b.WriteString(":")
+	writeJSONValue(&b, value)
+	b.WriteString(`,"caller":`)
+	writeJSONValue(&b, fmt.Sprint(lm.file, ":", lm.lline))
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, fmt.Sprint(lm.m...))
+	for i := 0; i < len(lm.fields); i += 2 {
+		b.WriteString(",")
+		writeJSONValue(&b, fmt.Sprint(lm.fields[i]))
+		b.WriteString(":")
+		writeJSONValue(&b, lm.fields[i+1])
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(encoded)
+}
+
+//Sets the LogLevel of the logger, safe to call while messages are logged
 func SetLevel(level string) error {
 	level = strings.ToUpper(level)
 	if nl, ok := lls[level]; ok {
-		logLevel = nl
+		atomic.StoreInt32(&logLevel, int32(nl))
 		return nil
 	}
 	return errors.New("INVALID LOG LEVEL: " + level)
 }
 
-//Sets the TimeFormat the logger should print out
-//Not currently used in this program
+//Returns an error if level isn't a known log level
+func CheckLevel(level string) error {
+	if _, ok := lls[strings.ToUpper(level)]; !ok {
+		return errors.New("INVALID LOG LEVEL: " + level)
+	}
+	return nil
+}
+
+//Returns an error if format isn't a known log format
+func CheckFormat(format string) error {
+	if _, ok := formats[strings.ToUpper(format)]; !ok {
+		return errors.New("INVALID LOG FORMAT: " + format)
+	}
+	return nil
+}
+
+//Sets the output format of the logger, "TEXT" (default) or "JSON"
+func SetFormat(format string) error {
+	format = strings.ToUpper(format)
+	if nf, ok := formats[format]; ok {
+		setLocked(func() { logFormat = nf })
+		return nil
+	}
+	return errors.New("INVALID LOG FORMAT: " + format)
+}
+
+//Sets the layout of timestamps in the text format, see time.Format
+//The JSON format always uses RFC3339
 func SetTimeFormat(tf string) {
-	timeFormat = tf
+	setLocked(func() { timeFormat = tf })
 }
 
 //Creates logMessage object
-func makeLogMessage(m []interface{}, level string) *logMessage {
-	_, file, lline, _ := runtime.Caller(3)
-	return &logMessage{m, filepath.Base(file), lline, level}
+//skip is the number of frames to skip when reporting the caller, 1 being the caller of makeLogMessage
+func makeLogMessage(m []interface{}, level string, fields []interface{}, skip int) *logMessage {
+	var pc [1]uintptr
+	runtime.Callers(skip+1, pc[:])
+	return &logMessage{m: m, level: level, fields: fields, pc: pc[0], time: time.Now()}
+
+}
 
+//Writes the logMessage iff logLevel<=int value of level
+//calldepth is the number of frames to skip when reporting the caller,
+//1 being the caller of Output, the way the standard library's log.Output works
+//Meant for wrappers around this package that want their caller reported
+func Output(calldepth int, level string, m ...interface{}) {
+	output(calldepth+1, level, nil, m)
+}
+
+func output(calldepth int, level string, fields []interface{}, m []interface{}) {
+	if nl, ok := lls[level]; ok && int(atomic.LoadInt32(&logLevel)) <= nl {
+		lm := makeLogMessage(m, level, fields, calldepth+1)
+		if !allow(lm) {
+			return
+		}
+		if !enqueue(lm) {
+			writeLogMessage(lm)
+		}
+	}
 }
 
 //NOTE: If LogLevel is set to ALL, all levels of logging will be visible
 
 //Writes the logMessage to stdOut iff logLevel<=int value of that "DEBUG"
 func Debug(m ...interface{}) {
-	if logLevel <= lls["DEBUG"] {
-		lm := makeLogMessage(m, "DEBUG")
-		writeLogMessage(lm)
-	}
+	output(2, "DEBUG", nil, m)
 }
 
 //Writes the logMessage to stdOut iff logLevel<=int value of that "ALL"
 func All(m ...interface{}) {
-	if logLevel <= lls["ALL"] {
-		lm := makeLogMessage(m, "ALL")
-		writeLogMessage(lm)
-	}
+	output(2, "ALL", nil, m)
 }
 
 //Writes the logMessage to stdOut iff logLevel<=int value of that "ERROR"
 func Error(m ...interface{}) {
-	if logLevel <= lls["ERROR"] {
-		lm := makeLogMessage(m, "ERROR")
-		writeLogMessage(lm)
-	}
+	output(2, "ERROR", nil, m)
 }
 
 //Writes the logMessage to stdOut iff logLevel<=int value of that "INFO"
 func Info(m ...interface{}) {
-	if logLevel <= lls["INFO"] {
-		lm := makeLogMessage(m, "INFO")
-		writeLogMessage(lm)
-	}
+	output(2, "INFO", nil, m)
 }
 
 //Writes the logMessage to stdOut iff logLevel<=int value of that "WARN"
 func Warn(m ...interface{}) {
-	if logLevel <= lls["WARN"] {
-		lm := makeLogMessage(m, "WARN")
-		writeLogMessage(lm)
+	output(2, "WARN", nil, m)
+}
+
+//Entry carries key/value fields that are added to every message logged through it
+//Created with With, e.g. logger.With("userId", 5).Info("connected")
+type Entry struct {
+	fields []interface{}
+}
+
+//Returns an Entry logging the given key/value pairs with every message
+//A key without a value gets a nil value
+func With(kv ...interface{}) *Entry {
+	return (&Entry{}).With(kv...)
+}
+
+//Returns a new Entry with kv added to the fields of e
+func (e *Entry) With(kv ...interface{}) *Entry {
+	if len(kv)%2 != 0 {
+		kv = append(kv, nil)
 	}
+	fields := make([]interface{}, 0, len(e.fields)+len(kv))
+	fields = append(fields, e.fields...)
+	return &Entry{append(fields, kv...)}
+}
+
+func (e *Entry) Debug(m ...interface{}) {
+	output(2, "DEBUG", e.fields, m)
+}
+
+func (e *Entry) All(m ...interface{}) {
+	output(2, "ALL", e.fields, m)
+}
+
+func (e *Entry) Error(m ...interface{}) {
+	output(2, "ERROR", e.fields, m)
+}
+
+func (e *Entry) Info(m ...interface{}) {
+	output(2, "INFO", e.fields, m)
+}
+
+func (e *Entry) Warn(m ...interface{}) {
+	output(2, "WARN", e.fields, m)
 }
 
 func init() {
-	timeFormat = "2006/01/02 - 15:00:05"
+	timeFormat = DefaultTimeFormat
 	mutex = &sync.Mutex{}
 }
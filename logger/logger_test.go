@@ -1,9 +1,16 @@
 package logger_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -71,3 +78,380 @@ func TestServer_LoggerTimeFormat(t *testing.T) {
 	}
 
 }
+
+func captureStdout(log func()) string {
+	stdOut := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	log()
+	w.Close()
+	output, _ := ioutil.ReadAll(r)
+	os.Stdout = stdOut
+	return string(output)
+}
+
+func TestServer_LoggerJSONFormat(t *testing.T) {
+	logger.SetLevel("INFO")
+	if err := logger.SetFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetFormat("text")
+	output := captureStdout(func() {
+		logger.With("userId", 5, "ok", true).With("err", errors.New("boom")).Info("User ", 5, " connected")
+	})
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &line); err != nil {
+		t.Fatal("Expected a single JSON object, got ", output, err)
+	}
+	if line["level"] != "INFO" || line["msg"] != "User 5 connected" {
+		t.Error("Unexpected level or message ", output)
+	}
+	if line["userId"] != 5.0 || line["ok"] != true || line["err"] != "boom" {
+		t.Error("Fields should keep their type ", output)
+	}
+	if caller, _ := line["caller"].(string); !strings.HasPrefix(caller, "logger_test.go:") {
+		t.Error("Expected the test to be reported as the caller, got ", caller)
+	}
+	if _, err := time.Parse(time.RFC3339, line["time"].(string)); err != nil {
+		t.Error("Expected an RFC3339 timestamp ", err)
+	}
+}
+
+func TestServer_LoggerTextFormatFields(t *testing.T) {
+	logger.SetLevel("INFO")
+	output := captureStdout(func() {
+		logger.With("userId", 5).Warn("slow")
+		logger.With("userId", 5).Debug("Shouldn't See This")
+	})
+	if !strings.Contains(output, "[slow] userId=5") || strings.Contains(output, "Shouldn't") {
+		t.Error("Expected fields after the message ", output)
+	}
+	if !strings.Contains(output, "logger_test.go") {
+		t.Error("Expected the test to be reported as the caller ", output)
+	}
+}
+
+func TestServer_LoggerFormatInvalid(t *testing.T) {
+	err := logger.SetFormat("xml")
+	if err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Log Format Error")
+	}
+}
+
+func TestServer_LoggerSinkLevels(t *testing.T) {
+	logger.SetLevel("ALL")
+	defer logger.SetLevel("INFO")
+	var debug, warn bytes.Buffer
+	if err := logger.SetSinks(logger.Sink{Writer: &debug, Level: "debug"}, logger.Sink{Writer: &warn, Level: "WARN"}); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetSinks()
+	logger.Info("only debug")
+	logger.Error("both")
+	if !strings.Contains(debug.String(), "only debug") || !strings.Contains(debug.String(), "both") {
+		t.Error("Debug sink should get every message ", debug.String())
+	}
+	if strings.Contains(warn.String(), "only debug") || !strings.Contains(warn.String(), "both") {
+		t.Error("Warn sink should only get the error ", warn.String())
+	}
+	if err := logger.SetSinks(logger.Sink{Writer: &debug, Level: "eva"}); err == nil {
+		t.Error("Should have given Invalid Log Level Error")
+	}
+}
+
+func TestServer_LoggerFileRotationBySize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.log")
+	rf, err := logger.OpenRotatingFile(path, logger.FileOptions{MaxBytes: 100, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 59) + "\n"
+	for i := 0; i < 10; i++ {
+		rf.Write([]byte(line))
+	}
+	if rotated := rf.Rotated(); len(rotated) != 2 {
+		t.Error("Expected 2 rotated files to be kept, got ", rotated)
+	}
+	rf.Close()
+	current, _ := ioutil.ReadFile(path)
+	if string(current) != line {
+		t.Errorf("Expected the current file to hold the last line, got %q", current)
+	}
+}
+
+func TestServer_LoggerFileRotationFailureKeepsLogging(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "server.log")
+	rf, err := logger.OpenRotatingFile(path, logger.FileOptions{MaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var other bytes.Buffer
+	logger.SetSinks(logger.Sink{Writer: &other})
+	defer logger.SetSinks()
+	logger.SetLevel("INFO")
+	line := strings.Repeat("x", 59) + "\n"
+	rf.Write([]byte(line))
+
+	//Neither moving the file aside nor opening a new one works without its directory
+	os.RemoveAll(filepath.Dir(path))
+	if n, err := rf.Write([]byte(line)); n != len(line) || err != nil {
+		t.Error("Expected the write to go to the current file, got ", n, " ", err)
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if n, err := rf.Write([]byte(line)); n != len(line) || err != nil {
+		t.Error("Expected writes to keep going to the current file, got ", n, " ", err)
+	}
+	rf.Close()
+	logger.Flush()
+	if !strings.Contains(other.String(), "Unable to rotate log file") || strings.Count(other.String(), "Unable to rotate") != 1 {
+		t.Errorf("Expected the rotation failure to be reported once through the other sinks, got %q", other.String())
+	}
+
+	//A file removed from under the logger is recreated on the next rotation
+	rf, err = logger.OpenRotatingFile(path, logger.FileOptions{MaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte(line))
+	os.Remove(path)
+	rf.Write([]byte(line))
+	rf.Close()
+	if current, _ := ioutil.ReadFile(path); string(current) != line {
+		t.Errorf("Expected a new file holding the last line, got %q", current)
+	}
+}
+
+func TestServer_LoggerFileRotationByAgeCompressed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.log")
+	rf, err := logger.OpenRotatingFile(path, logger.FileOptions{MaxAge: 20 * time.Millisecond, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write([]byte("old\n"))
+	time.Sleep(30 * time.Millisecond)
+	rf.Write([]byte("new\n"))
+	rotated := rf.Rotated()
+	if len(rotated) != 1 || !strings.HasSuffix(rotated[0], ".gz") {
+		t.Fatal("Expected one compressed rotated file, got ", rotated)
+	}
+	f, _ := os.Open(rotated[0])
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, _ := ioutil.ReadAll(zr); string(old) != "old\n" {
+		t.Errorf("Unexpected rotated content %q", old)
+	}
+}
+
+func TestServer_LoggerConfigureSinks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "server.log")
+	logger.SetLevel("INFO")
+	err := logger.Configure([]logger.SinkConfig{{Type: "stdout", Level: "error"}, {Type: "file", Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := captureStdout(func() {
+		logger.Info("to the file")
+	})
+	logger.SetSinks()
+	logged, _ := ioutil.ReadFile(path)
+	if strings.Contains(output, "to the file") || !strings.Contains(string(logged), "to the file") {
+		t.Error("Expected the message in the file only, stdout: ", output, " file: ", string(logged))
+	}
+	if err := logger.Configure([]logger.SinkConfig{{Type: "syslog"}}); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Log Sink Error")
+	}
+}
+
+func TestServer_LoggerDefaultTimeFormat(t *testing.T) {
+	logger.SetLevel("INFO")
+	logger.SetTimeFormat(logger.DefaultTimeFormat)
+	logger.SetTimeZone("UTC")
+	defer logger.SetTimeZone("local")
+	before := time.Now().UTC().Format("2006/01/02 - 15:04")
+	output := captureStdout(func() {
+		logger.Info("Testing Default Format")
+	})
+	after := time.Now().UTC().Format("2006/01/02 - 15:04")
+	if !strings.Contains(output, before) && !strings.Contains(output, after) {
+		t.Error("Expected hours and minutes in the timestamp ", output)
+	}
+}
+
+func TestServer_LoggerTimePrecision(t *testing.T) {
+	logger.SetLevel("INFO")
+	logger.SetTimeFormat("15:04:05 MST")
+	defer logger.SetTimeFormat(logger.DefaultTimeFormat)
+	logger.SetTimeZone("utc")
+	defer logger.SetTimeZone("local")
+	logger.SetTimePrecision(3)
+	defer logger.SetTimePrecision(0)
+	output := captureStdout(func() {
+		logger.Info("Testing Precision")
+	})
+	if !regexp.MustCompile(`\d\d:\d\d:\d\d\.\d{3} UTC`).MatchString(output) {
+		t.Error("Expected milliseconds before the zone ", output)
+	}
+	if err := logger.SetTimePrecision(10); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Time Precision Error")
+	}
+	if err := logger.SetTimeZone("mars"); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Time Zone Error")
+	}
+}
+
+func TestServer_LoggerElapsedTimeMode(t *testing.T) {
+	logger.SetLevel("INFO")
+	logger.SetTimePrecision(3)
+	defer logger.SetTimePrecision(0)
+	if err := logger.SetTimeMode("elapsed"); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetTimeMode("wall")
+	output := captureStdout(func() {
+		logger.Info("Testing Elapsed")
+	})
+	if !strings.Contains(output, " 0.0") || !strings.Contains(output, "s --") {
+		t.Error("Expected the elapsed seconds as timestamp ", output)
+	}
+	logger.SetFormat("json")
+	defer logger.SetFormat("text")
+	output = captureStdout(func() {
+		logger.Info("Testing Elapsed")
+	})
+	var line map[string]interface{}
+	json.Unmarshal([]byte(output), &line)
+	if elapsed, ok := line["elapsed"].(float64); !ok || elapsed < 0 || elapsed > 1 || line["time"] != nil {
+		t.Error("Expected elapsed seconds instead of the time ", output)
+	}
+	if err := logger.SetTimeMode("sundial"); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Time Mode Error")
+	}
+}
+
+//gatedWriter holds every write until it is opened
+type gatedWriter struct {
+	gate  chan struct{}
+	mutex sync.Mutex
+	lines []string
+}
+
+func (gw *gatedWriter) Write(p []byte) (int, error) {
+	<-gw.gate
+	gw.mutex.Lock()
+	gw.lines = append(gw.lines, string(p))
+	gw.mutex.Unlock()
+	return len(p), nil
+}
+
+func logAsync(t *testing.T, overflow string, messages int) (*gatedWriter, int64) {
+	logger.SetLevel("INFO")
+	gw := &gatedWriter{gate: make(chan struct{})}
+	logger.SetSinks(logger.Sink{Writer: gw})
+	defer logger.SetSinks()
+	if err := logger.SetAsync(4, overflow); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetAsync(0, "block")
+	before := logger.Dropped()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < messages; i++ {
+			logger.Info("message ", i)
+		}
+		close(done)
+	}()
+	if overflow == "drop" {
+		<-done
+	} else {
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(gw.gate)
+	<-done
+	logger.Flush()
+	return gw, logger.Dropped() - before
+}
+
+func TestServer_LoggerAsyncBlock(t *testing.T) {
+	gw, dropped := logAsync(t, "block", 50)
+	if len(gw.lines) != 50 || dropped != 0 {
+		t.Error("Expected every message to be written, got ", len(gw.lines), " dropped ", dropped)
+	}
+	if !strings.Contains(gw.lines[0], "logger_test.go") || !strings.Contains(gw.lines[49], " 49]") {
+		t.Error("Expected the caller and messages in order ", gw.lines[0], gw.lines[49])
+	}
+}
+
+func TestServer_LoggerAsyncDrop(t *testing.T) {
+	gw, dropped := logAsync(t, "drop", 50)
+	if int64(len(gw.lines))+dropped != 50 || len(gw.lines) > 5 {
+		t.Error("Expected a full buffer to drop messages, wrote ", len(gw.lines), " dropped ", dropped)
+	}
+}
+
+func TestServer_LoggerAsyncSample(t *testing.T) {
+	gw, dropped := logAsync(t, "sample", 1000)
+	if int64(len(gw.lines))+dropped != 1000 || dropped == 0 || len(gw.lines) < 5 {
+		t.Error("Expected some overflowing messages to be kept, wrote ", len(gw.lines), " dropped ", dropped)
+	}
+	if err := logger.SetAsync(4, "shrug"); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Log Overflow Policy Error")
+	}
+}
+
+func TestServer_LoggerRateLimit(t *testing.T) {
+	logger.SetLevel("INFO")
+	gw := &gatedWriter{gate: make(chan struct{})}
+	close(gw.gate)
+	logger.SetSinks(logger.Sink{Writer: gw})
+	defer logger.SetSinks()
+	if err := logger.SetRateLimit(2, 10, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetRateLimit(0, 0, 0)
+	flood := func(n int) {
+		for i := 1; i <= n; i++ {
+			logger.Error("flood ", i)
+		}
+	}
+	flood(50)
+	logger.Error("other call site")
+	count := func(substr string) int {
+		gw.mutex.Lock()
+		defer gw.mutex.Unlock()
+		n := 0
+		for _, line := range gw.lines {
+			if strings.Contains(line, substr) {
+				n++
+			}
+		}
+		return n
+	}
+	//1 and 2, then one in 10 of the rest: 12, 22, 32 and 42
+	if count("flood") != 6 || count("other call site") != 1 {
+		t.Error("Expected 6 sampled messages and the other call site, got ", gw.lines)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if count("Suppressed  44  similar messages") != 1 || count("suppressed=44") != 1 {
+		t.Error("Expected a summary of the 44 suppressed messages, got ", gw.lines)
+	}
+	//The call site starts over in the next interval
+	flood(3)
+	if count("flood") != 8 {
+		t.Error("Expected the first 2 messages of the new interval, got ", gw.lines)
+	}
+	if err := logger.SetRateLimit(-1, 0, time.Second); err == nil || !strings.Contains(err.Error(), "INVALID") {
+		t.Error("Should have given Invalid Log Rate Limit Error")
+	}
+}
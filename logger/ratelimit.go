@@ -0,0 +1,135 @@
+package logger
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//rateLimiter lets the first messages of every call site through in each
+//interval and samples the rest, a summary of what was suppressed is logged
+//for every call site at the end of the interval
+//Logging never takes a lock, every call site counts on its own with atomic counters
+type rateLimiter struct {
+	first      int64
+	thereafter int64
+	interval   time.Duration
+	//Call site program counters to their *siteCount
+	sites sync.Map
+	//Incremented at the end of every interval
+	epoch   int64
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type siteCount struct {
+	level string
+	//Interval the count belongs to
+	epoch      int64
+	count      int64
+	suppressed int64
+}
+
+var (
+	//Serializes SetRateLimit, logging only loads the limiter
+	rateMutex sync.Mutex
+	limiter   atomic.Value
+)
+
+//Limits every call site to first messages per interval, after which only one
+//in every thereafter messages is logged, zero dropping all of them
+//The number of suppressed messages of a call site is logged at the end of the interval
+//A first of 0 turns rate limiting off
+func SetRateLimit(first int, thereafter int, interval time.Duration) error {
+	if first < 0 || thereafter < 0 || (first > 0 && interval <= 0) {
+		return errors.New("INVALID LOG RATE LIMIT: first " + strconv.Itoa(first) + ", thereafter " + strconv.Itoa(thereafter) + ", interval " + interval.String())
+	}
+	var next *rateLimiter
+	if first > 0 {
+		next = &rateLimiter{
+			first:      int64(first),
+			thereafter: int64(thereafter),
+			interval:   interval,
+			stop:       make(chan struct{}),
+			stopped:    make(chan struct{}),
+		}
+		go next.run()
+	}
+	rateMutex.Lock()
+	previous, _ := limiter.Load().(*rateLimiter)
+	limiter.Store(next)
+	rateMutex.Unlock()
+	if previous != nil {
+		close(previous.stop)
+		<-previous.stopped
+	}
+	return nil
+}
+
+//Returns false if the message should be suppressed
+func allow(lm *logMessage) bool {
+	rl, _ := limiter.Load().(*rateLimiter)
+	if rl == nil {
+		return true
+	}
+	value, ok := rl.sites.Load(lm.pc)
+	if !ok {
+		value, _ = rl.sites.LoadOrStore(lm.pc, &siteCount{level: lm.level, epoch: atomic.LoadInt64(&rl.epoch)})
+	}
+	site := value.(*siteCount)
+	//The first message of a call site in a new interval starts its count over
+	epoch := atomic.LoadInt64(&rl.epoch)
+	if seen := atomic.LoadInt64(&site.epoch); seen != epoch && atomic.CompareAndSwapInt64(&site.epoch, seen, epoch) {
+		atomic.StoreInt64(&site.count, 0)
+	}
+	count := atomic.AddInt64(&site.count, 1)
+	if count <= rl.first {
+		return true
+	}
+	if rl.thereafter > 0 && (count-rl.first)%rl.thereafter == 0 {
+		return true
+	}
+	atomic.AddInt64(&site.suppressed, 1)
+	return false
+}
+
+func (rl *rateLimiter) run() {
+	defer close(rl.stopped)
+	ticker := time.NewTicker(rl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rl.summarize()
+		case <-rl.stop:
+			rl.summarize()
+			return
+		}
+	}
+}
+
+//Starts a new interval and logs the suppressed counts as if they came
+//from the call sites themselves
+func (rl *rateLimiter) summarize() {
+	atomic.AddInt64(&rl.epoch, 1)
+	rl.sites.Range(func(key, value interface{}) bool {
+		site := value.(*siteCount)
+		suppressed := atomic.SwapInt64(&site.suppressed, 0)
+		if suppressed == 0 {
+			return true
+		}
+		lm := &logMessage{
+			m:      []interface{}{"Suppressed ", suppressed, " similar messages in the last ", rl.interval},
+			level:  site.level,
+			fields: []interface{}{"suppressed", suppressed},
+			pc:     key.(uintptr),
+			time:   time.Now(),
+		}
+		if !enqueue(lm) {
+			writeLogMessage(lm)
+		}
+		return true
+	})
+}
@@ -0,0 +1,161 @@
+package logger
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+//Sink is a destination for log messages
+//Only messages at Level or above are written to it, "" means every level
+//that passes the logger's own level
+type Sink struct {
+	Writer io.Writer
+	Level  string
+}
+
+type sink struct {
+	w     io.Writer
+	level int
+}
+
+//stdStream resolves the stream when written to, so replacing os.Stdout
+//or os.Stderr (e.g. in tests) is picked up
+type stdStream struct {
+	stderr bool
+}
+
+func (s stdStream) Write(p []byte) (int, error) {
+	if s.stderr {
+		return os.Stderr.Write(p)
+	}
+	return os.Stdout.Write(p)
+}
+
+var (
+	//Stdout writes to whatever os.Stdout is at the time of writing
+	Stdout io.Writer = stdStream{}
+	//Stderr writes to whatever os.Stderr is at the time of writing
+	Stderr io.Writer = stdStream{stderr: true}
+
+	sinks = []sink{{Stdout, 0}}
+)
+
+//Replaces the sinks every message is fanned out to
+//Writers of the replaced sinks that implement io.Closer are closed
+//Without any sink the logger goes back to writing to Stdout
+func SetSinks(ss ...Sink) error {
+	next := make([]sink, 0, len(ss))
+	for _, s := range ss {
+		level := 0
+		if s.Level != "" {
+			nl, ok := lls[strings.ToUpper(s.Level)]
+			if !ok {
+				return errors.New("INVALID LOG LEVEL: " + s.Level)
+			}
+			level = nl
+		}
+		next = append(next, sink{s.Writer, level})
+	}
+	if len(next) == 0 {
+		next = append(next, sink{Stdout, 0})
+	}
+	mutex.Lock()
+	previous := sinks
+	sinks = next
+	mutex.Unlock()
+	closeSinks(previous, next)
+	return nil
+}
+
+//Closes the writers of previous that aren't in use by next
+func closeSinks(previous []sink, next []sink) {
+	for _, old := range previous {
+		closer, ok := old.w.(io.Closer)
+		if !ok {
+			continue
+		}
+		inUse := false
+		for _, s := range next {
+			if s.w == old.w {
+				inUse = true
+			}
+		}
+		if !inUse {
+			closer.Close()
+		}
+	}
+}
+
+//Writes a formatted message to every sink accepting its level
+//Must be called with the mutex held
+func writeSinks(level string, p []byte) {
+	nl := lls[level]
+	for _, s := range sinks {
+		if s.level <= nl {
+			s.w.Write(p)
+		}
+	}
+}
+
+//SinkConfig describes a sink in conf.json
+//Type is "stdout", "stderr" or "file", the remaining fields only apply to files
+type SinkConfig struct {
+	Type  string
+	Level string
+	Path  string
+	//Size in bytes after which the file is rotated, zero disables it
+	MaxBytes int64
+	//Age after which the file is rotated, zero disables it
+	MaxAgeMs int
+	//Number of rotated files kept, zero keeps all of them
+	MaxBackups int
+	//Gzip rotated files
+	Compress bool
+}
+
+//Creates the sinks described by confs and makes them the logger's sinks
+//Nothing is changed if any of them fails to open
+func Configure(confs []SinkConfig) error {
+	var ss []Sink
+	for _, conf := range confs {
+		var w io.Writer
+		switch strings.ToUpper(conf.Type) {
+		case "STDOUT":
+			w = Stdout
+		case "STDERR":
+			w = Stderr
+		case "FILE":
+			rf, err := OpenRotatingFile(conf.Path, FileOptions{
+				MaxBytes:   conf.MaxBytes,
+				MaxAge:     time.Duration(conf.MaxAgeMs) * time.Millisecond,
+				MaxBackups: conf.MaxBackups,
+				Compress:   conf.Compress,
+			})
+			if err != nil {
+				closeSinks(toSinks(ss), nil)
+				return err
+			}
+			w = rf
+		default:
+			closeSinks(toSinks(ss), nil)
+			return errors.New("INVALID LOG SINK: " + conf.Type)
+		}
+		ss = append(ss, Sink{w, conf.Level})
+	}
+	if err := SetSinks(ss...); err != nil {
+		closeSinks(toSinks(ss), nil)
+		return err
+	}
+	return nil
+}
+
+func toSinks(ss []Sink) []sink {
+	converted := make([]sink, len(ss))
+	for i, s := range ss {
+		converted[i] = sink{w: s.Writer}
+	}
+	return converted
+}
@@ -1,111 +1,76 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sahilahmadlone/MessagingSocketServer/config"
 	"github.com/sahilahmadlone/MessagingSocketServer/logger"
 	"github.com/sahilahmadlone/MessagingSocketServer/server"
 )
 
-//Checks for valid parameters via commandline arguments
-//Returns variable and value if appropriate
-func parseEnvVar(val string) (string, string) {
-	splitVal := strings.Split(val, "=")
-	if len(splitVal) != 2 {
-		return "", ""
-	}
-	envVar := splitVal[0]
-	envVal := splitVal[1]
-	return envVar, envVal
-
-}
-
-//Simple check error function
-func checkError(err error) bool {
-	if err != nil {
-		logger.Error("Not a valid environment value ", err, " reverting to default config")
-		return false
-	}
-	return true
-}
-
-//Updates and overrides default config values
-func exportVals(env string, val string, conf config.ServerConfig) config.ServerConfig {
-	switch env {
-	case "logLevel":
-		if ok := checkError(logger.SetLevel(val)); ok {
-			conf.LogLevel = val
-		}
-	case "eventListenerPort":
-		val, err := strconv.Atoi(val)
-		if ok := checkError(err); ok {
-			conf.EventListenerPort = val
-		}
-	case "clientListenerPort":
-		val, err := strconv.Atoi(val)
-		if ok := checkError(err); ok {
-			conf.EventListenerPort = val
-		}
-	case "sequenceNumber":
-		val, err := strconv.Atoi(val)
-		if ok := checkError(err); ok {
-			conf.EventListenerPort = val
-		}
-	}
-
-	return conf
-
-}
-
-//Updates config according to valid commandline args
-//If parsed arguments are valid
-func overRideDefaultConfig(args []string, conf config.ServerConfig) *config.ServerConfig {
-	for i := 1; i < len(args); i++ {
-		env, val := parseEnvVar(args[1])
-		if env == "" && val == "" {
-			logger.Error("Invalid commandline arguments ", env, " ", val, "reverting to default config")
-		} else {
-			conf = exportVals(env, val, conf)
-
-		}
-	}
-	return &conf
-}
-
 //Sets up configuration for Environment
 //Starts the Server
-//Checks for server configs by commandline
-//Catches unexpected signals
+//Loads server configs from conf.json, environment variables and commandline flags
+//Reloads the configuration on SIGHUP without dropping connections
+//Drains queued events to users on SIGINT or SIGTERM before exiting
 func main() {
-	var conf *config.ServerConfig
-	conf = config.ServerDefaultConfig("config/")
-	if len(os.Args) > 1 {
-		conf = overRideDefaultConfig(os.Args, *conf)
+	conf, err := config.Load(os.Args[1:], os.Environ())
+	if err == flag.ErrHelp {
+		config.Usage(os.Stderr)
+		os.Exit(0)
 	}
+	if err != nil {
+		for _, problem := range err.(config.Errors) {
+			logger.Error("Invalid configuration: ", problem)
+		}
+		config.Usage(os.Stderr)
+		os.Exit(2)
+	}
+	config.ConfigureLogger(conf)
 
 	logger.Info("Starting Server:")
-	server, err := server.Run(*conf)
+	server, err := server.Run(conf)
 	if err != nil {
-		recover()
+		logger.Error("Unable to start Server ", err)
+		logger.Flush()
 		os.Exit(1)
 	}
 
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt)
-	for sig := range sigChannel {
-		if sig == os.Interrupt {
-			logger.Info("Graceful ShutDown of Server")
-			os.Exit(1)
-
-		}
+	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigChannel
+	for sig == syscall.SIGHUP {
+		conf = reload(server, conf)
+		sig = <-sigChannel
 	}
-	if err := server.ShutDown(); err != nil {
+	logger.Info("Received ", sig, ", graceful ShutDown of Server")
+	if _, err := server.Drain(time.Duration(conf.ShutdownTimeoutMs) * time.Millisecond); err != nil {
 		logger.Error("Error shutting down Server, exiting now.")
-		recover()
+		logger.Flush()
 		os.Exit(1)
 	}
+	logger.Flush()
+}
+
+//Re-reads the configuration from the same file, environment and flags as on startup
+//and applies what can change to the logger and the running server
+//Returns the configuration now in effect, the running one if the new one is invalid
+func reload(s *server.Server, running config.ServerConfig) config.ServerConfig {
+	logger.Info("Received SIGHUP, reloading configuration")
+	conf, err := config.Load(os.Args[1:], os.Environ())
+	if err != nil {
+		for _, problem := range err.(config.Errors) {
+			logger.Error("Invalid configuration, keeping the running one: ", problem)
+		}
+		return running
+	}
+	if _, err := s.Reload(conf); err != nil {
+		return running
+	}
+	config.ReconfigureLogger(running, conf)
+	return conf
 }
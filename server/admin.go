@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Admin API served over HTTP when AdminListenerPort is set, on AdminListenerAddress
+//  GET  /status                 overview of the dispatcher and counters
+//  GET  /users                  connected users, the queue depth of each session and their write errors
+//  GET  /followers              follower count of every followed user
+//  GET  /followers/export       the follower graph, one "followerId|followedId" line per follow
+//  POST /followers/import       replaces the follower graph with the one in the request body
+//  GET  /graph/followers?id=N  followers of user N, paginated with offset and limit
+//  GET  /graph/followees?id=N  users that user N follows, paginated with offset and limit
+//  GET  /graph/counts?id=N     follower and followee counts of user N
+//  GET  /graph/follows?follower=A&followed=B  whether user A follows user B
+//  GET  /graph/mutual?a=A&b=B  whether users A and B follow each other
+//  GET  /graph/users           follower and followee counts of every user, paginated
+//  GET  /sources                remote addresses of connected event sources
+//  GET  /metrics                metrics in the Prometheus text exposition format
+//  POST /users/disconnect?id=N  closes every session of user N
+//  POST /loglevel?level=DEBUG   changes the log level at runtime
+
+//Limits on how long a client may take to send a request, so idle or slow
+//connections can't tie up the admin API
+const (
+	adminReadHeaderTimeout = 5 * time.Second
+	adminReadTimeout       = 30 * time.Second
+)
+
+//levelSetter is implemented by loggers whose level can be changed at runtime
+type levelSetter interface {
+	SetLevel(level string) error
+}
+
+type adminStatus struct {
+	NextSequence            int   `json:"nextSequence"`
+	ReorderBuffer           int   `json:"reorderBuffer"`
+	ConnectedUsers          int   `json:"connectedUsers"`
+	ConnectedSessions       int   `json:"connectedSessions"`
+	EventSources            int   `json:"eventSources"`
+	SkippedSequences        int64 `json:"skippedSequences"`
+	ReorderStalls           int64 `json:"reorderStalls"`
+	DroppedEvents           int64 `json:"droppedEvents"`
+	SlowConsumerDisconnects int64 `json:"slowConsumerDisconnects"`
+	MailboxDepth            int64 `json:"mailboxDepth"`
+	MailboxDropped          int64 `json:"mailboxDropped"`
+}
+
+type adminUser struct {
+	UserId      int   `json:"userId"`
+	QueueDepths []int `json:"queueDepths"`
+	WriteErrors int64 `json:"writeErrors"`
+}
+
+func (ms *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", ms.adminGet(ms.adminStatus))
+	mux.HandleFunc("/users", ms.adminGet(ms.adminUsers))
+	mux.HandleFunc("/followers", ms.adminGet(ms.adminFollowers))
+	mux.HandleFunc("/followers/export", ms.adminExportFollowers)
+	mux.HandleFunc("/followers/import", ms.adminImportFollowers)
+	mux.HandleFunc("/graph/followers", ms.adminQuery(queryFollowers))
+	mux.HandleFunc("/graph/followees", ms.adminQuery(queryFollowees))
+	mux.HandleFunc("/graph/counts", ms.adminQuery(queryCounts))
+	mux.HandleFunc("/graph/follows", ms.adminQuery(queryFollows))
+	mux.HandleFunc("/graph/mutual", ms.adminQuery(queryMutual))
+	mux.HandleFunc("/graph/users", ms.adminQuery(queryUsers))
+	mux.HandleFunc("/sources", ms.adminGet(func() (interface{}, bool) {
+		return ms.sources.addrs(), true
+	}))
+	mux.HandleFunc("/metrics", ms.adminMetrics)
+	mux.HandleFunc("/users/disconnect", ms.adminDisconnect)
+	mux.HandleFunc("/loglevel", ms.adminLogLevel)
+	return mux
+}
+
+//Starts serving the admin API if a listener was passed in or a port is configured
+func (ms *Server) startAdmin() error {
+	if ms.AListener == nil {
+		if ms.conf.AdminListenerPort == 0 {
+			return nil
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(ms.conf.AdminListenerAddress, strconv.Itoa(ms.conf.AdminListenerPort)))
+		if err != nil {
+			return err
+		}
+		ms.AListener = listener
+	}
+	ms.admin = &http.Server{
+		Handler:           ms.adminHandler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+	}
+	go ms.admin.Serve(ms.AListener)
+	ms.log.Info("Admin API listening on ", ms.AListener.Addr())
+	return nil
+}
+
+func (ms *Server) closeAdmin() {
+	if ms.admin != nil {
+		ms.admin.Close()
+	} else if ms.AListener != nil {
+		ms.AListener.Close()
+	}
+}
+
+//Wraps a read only endpoint, report returns false once the server has stopped
+func (ms *Server) adminGet(report func() (interface{}, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, ok := report()
+		if !ok {
+			http.Error(w, "server is shut down", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, body)
+	}
+}
+
+//Wraps a follower graph query, answered from the replica without going through the dispatcher
+func (ms *Server) adminQuery(query func(q FollowerQuery, params url.Values) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := query(ms.FollowerQuery(), r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, body)
+	}
+}
+
+func (ms *Server) adminStatus() (interface{}, bool) {
+	status := adminStatus{}
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		status.NextSequence = st.SequenceNum
+		status.ReorderBuffer = st.MessageQueue.Len()
+		st.Shards.each(func(reg *userRegistry) {
+			status.ConnectedUsers += reg.users()
+			status.ConnectedSessions += reg.count()
+		})
+	})
+	status.EventSources = len(ms.sources.addrs())
+	status.SkippedSequences = ms.Stats.SkippedSequences()
+	status.ReorderStalls = ms.Stats.ReorderStalls()
+	status.DroppedEvents = ms.Stats.DroppedEvents()
+	status.SlowConsumerDisconnects = ms.Stats.SlowConsumerDisconnects()
+	status.MailboxDepth = ms.Stats.MailboxDepth()
+	status.MailboxDropped = ms.Stats.MailboxDropped()
+	return status, ok
+}
+
+func (ms *Server) adminUsers() (interface{}, bool) {
+	users := []adminUser{}
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		st.Shards.each(func(reg *userRegistry) {
+			for userId, sessions := range reg.sessions {
+				user := adminUser{UserId: userId, WriteErrors: ms.Stats.UserWriteErrorsFor(userId)}
+				for _, session := range sessions {
+					user.QueueDepths = append(user.QueueDepths, len(session.queue))
+				}
+				users = append(users, user)
+			}
+		})
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].UserId < users[j].UserId })
+	return users, ok
+}
+
+func (ms *Server) adminFollowers() (interface{}, bool) {
+	followers := make(map[string]int)
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		st.FollowerMap.Each(func(followed int, fm []int) {
+			if len(fm) > 0 {
+				followers[strconv.Itoa(followed)] = len(fm)
+			}
+		})
+	})
+	return followers, ok
+}
+
+func (ms *Server) adminExportFollowers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var export bytes.Buffer
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		writeFollowerGraph(&export, st.FollowerMap)
+	})
+	if !ok {
+		http.Error(w, "server is shut down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	export.WriteTo(w)
+}
+
+//File-backed graphs snapshot the imported graph right away, marked with the last dispatched
+//sequence number so replaying the event log doesn't undo it
+func (ms *Server) adminImportFollowers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	follows, err := readFollowerGraph(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count := 0
+	for _, followers := range follows {
+		count += len(followers)
+	}
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		if err = st.FollowerMap.Replace(follows); err != nil {
+			return
+		}
+		ms.replica.reset(st.FollowerMap)
+		//Logged follows dispatched before the import must not be replayed over it
+		if tracker, isTracker := st.FollowerMap.(SequenceTracker); isTracker {
+			err = tracker.MarkApplied(st.SequenceNum - 1)
+		}
+	})
+	if !ok {
+		http.Error(w, "server is shut down", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		ms.log.Error("Unable to store imported follower graph ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ms.log.Info("Admin imported follower graph of ", count, " follows")
+	writeJSON(w, map[string]int{"follows": count})
+}
+
+func (ms *Server) adminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	ms.Stats.WritePrometheus(w)
+}
+
+func (ms *Server) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+	closed := 0
+	ok := ms.inDispatcher(func(st *dispatchState) {
+		st.Shards.call(st.Shards.of(userId), func(reg *userRegistry) {
+			for _, session := range reg.get(userId) {
+				//The watcher notices the closed connection and unregisters the session
+				session.close()
+				closed++
+			}
+		})
+	})
+	if !ok {
+		http.Error(w, "server is shut down", http.StatusServiceUnavailable)
+		return
+	}
+	if closed == 0 {
+		http.Error(w, "user not connected", http.StatusNotFound)
+		return
+	}
+	ms.log.Info("Admin disconnected ", closed, " sessions of user ", userId)
+	writeJSON(w, map[string]int{"userId": userId, "sessions": closed})
+}
+
+func (ms *Server) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	setter, ok := ms.log.(levelSetter)
+	if !ok {
+		http.Error(w, "logger does not support changing the level", http.StatusNotImplemented)
+		return
+	}
+	level := r.URL.Query().Get("level")
+	if err := setter.SetLevel(level); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ms.log.Info("Admin set log level to ", level)
+	writeJSON(w, map[string]string{"level": level})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+//Page size of the graph queries when no limit is given, and the largest allowed
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func queryFollowers(q FollowerQuery, params url.Values) (interface{}, error) {
+	user, err := intParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, err := pageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return q.Followers(user, offset, limit), nil
+}
+
+func queryFollowees(q FollowerQuery, params url.Values) (interface{}, error) {
+	user, err := intParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, err := pageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return q.Followees(user, offset, limit), nil
+}
+
+func queryCounts(q FollowerQuery, params url.Values) (interface{}, error) {
+	user, err := intParam(params, "id")
+	if err != nil {
+		return nil, err
+	}
+	return q.Counts(user), nil
+}
+
+func queryFollows(q FollowerQuery, params url.Values) (interface{}, error) {
+	follower, err := intParam(params, "follower")
+	if err != nil {
+		return nil, err
+	}
+	followed, err := intParam(params, "followed")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"follower": follower, "followed": followed, "follows": q.Follows(follower, followed)}, nil
+}
+
+func queryMutual(q FollowerQuery, params url.Values) (interface{}, error) {
+	a, err := intParam(params, "a")
+	if err != nil {
+		return nil, err
+	}
+	b, err := intParam(params, "b")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"a": a, "b": b, "mutual": q.Mutual(a, b)}, nil
+}
+
+func queryUsers(q FollowerQuery, params url.Values) (interface{}, error) {
+	offset, limit, err := pageParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return q.Users(offset, limit), nil
+}
+
+func intParam(params url.Values, name string) (int, error) {
+	value, err := strconv.Atoi(params.Get(name))
+	if err != nil {
+		return 0, errors.New("invalid " + name)
+	}
+	return value, nil
+}
+
+//Reads offset and limit, both optional, limit defaults to defaultPageLimit and is capped at maxPageLimit
+func pageParams(params url.Values) (int, int, error) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if params.Get("offset") != "" {
+		if offset, err = intParam(params, "offset"); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	if params.Get("limit") != "" {
+		if limit, err = intParam(params, "limit"); err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return offset, limit, nil
+}
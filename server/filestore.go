@@ -0,0 +1,571 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
+)
+
+//journal persists a store in dir as a snapshot file of the whole state,
+//one line per entry, plus a write-ahead log of the changes made since
+//Stores keep their state in memory and only write to the journal
+//Replaying the journal over a newer snapshot must give the same state,
+//so a crash between writing a snapshot and clearing the journal loses nothing
+type journal struct {
+	dir  string
+	opts wal.Options
+	log  *wal.Log
+}
+
+//Opens the journal in dir, handing every line of the snapshot to load
+//and then every record of the journal to replay
+func openJournal(dir string, opts wal.Options, load func(line string) error, replay func(record string) error) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journal{dir: dir, opts: opts}
+	file, err := os.Open(j.snapshotPath())
+	if err == nil {
+		err = readLines(file, load)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", j.snapshotPath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	j.log, err = wal.Open(j.journalPath(), opts)
+	if err != nil {
+		return nil, err
+	}
+	err = j.log.Replay(func(record []byte) error {
+		return replay(string(record))
+	})
+	if err != nil {
+		j.log.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) append(record string) error {
+	return j.log.Append([]byte(record))
+}
+
+//Replaces the snapshot with the lines written by write and starts an empty journal
+func (j *journal) snapshot(write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(j.dir, "snapshot")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.snapshotPath())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := j.log.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(j.journalPath()); err != nil {
+		return err
+	}
+	j.log, err = wal.Open(j.journalPath(), j.opts)
+	return err
+}
+
+func (j *journal) close() error {
+	return j.log.Close()
+}
+
+func (j *journal) snapshotPath() string {
+	return filepath.Join(j.dir, "snapshot")
+}
+
+func (j *journal) journalPath() string {
+	return filepath.Join(j.dir, "journal")
+}
+
+//Hands every non blank line of r to fn, errors name the line number
+func readLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+//Splits a "|" separated record into exactly n fields, the last one taking the rest of the record
+func splitRecord(record string, n int) ([]string, error) {
+	fields := strings.SplitN(record, "|", n)
+	if len(fields) != n {
+		return nil, fmt.Errorf("invalid record %q", record)
+	}
+	return fields, nil
+}
+
+//Parses the integer fields of a record
+func atoiFields(record string, fields ...string) ([]int, error) {
+	ints := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in record %q", field, record)
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+//fileFollowerGraph keeps the follower graph in memory and journals every follow ("F|follower|followed"),
+//unfollow ("U|follower|followed") and applied sequence number ("A|sequence")
+//The snapshot starts with the applied sequence number ("A|sequence") followed by one "follower|followed" line per follow
+type fileFollowerGraph struct {
+	*memoryFollowerGraph
+	journal *journal
+	applied int
+}
+
+//Opens the FollowerGraph stored in dir, creating it if needed
+//Snapshot writes the whole graph and clears the journal
+func OpenFileFollowerGraph(dir string, opts wal.Options) (FollowerGraph, error) {
+	fg := &fileFollowerGraph{memoryFollowerGraph: NewMemoryFollowerGraph().(*memoryFollowerGraph), applied: -1}
+	var err error
+	fg.journal, err = openJournal(dir, opts, func(line string) error {
+		if strings.HasPrefix(line, "A|") {
+			return fg.loadApplied(line)
+		}
+		follower, followed, err := parseFollow(line)
+		if err != nil {
+			return err
+		}
+		return fg.memoryFollowerGraph.Follow(follower, followed)
+	}, func(record string) error {
+		if strings.HasPrefix(record, "A|") {
+			return fg.loadApplied(record)
+		}
+		fields, err := splitRecord(record, 2)
+		if err != nil {
+			return err
+		}
+		follower, followed, err := parseFollow(fields[1])
+		if err != nil {
+			return err
+		}
+		switch fields[0] {
+		case "F":
+			return fg.memoryFollowerGraph.Follow(follower, followed)
+		case "U":
+			return fg.memoryFollowerGraph.Unfollow(follower, followed)
+		}
+		return fmt.Errorf("invalid follow record %q", record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fg, nil
+}
+
+func (fg *fileFollowerGraph) Follow(follower int, followed int) error {
+	if err := fg.journal.append("F|" + strconv.Itoa(follower) + "|" + strconv.Itoa(followed)); err != nil {
+		return err
+	}
+	return fg.memoryFollowerGraph.Follow(follower, followed)
+}
+
+func (fg *fileFollowerGraph) Unfollow(follower int, followed int) error {
+	if err := fg.journal.append("U|" + strconv.Itoa(follower) + "|" + strconv.Itoa(followed)); err != nil {
+		return err
+	}
+	return fg.memoryFollowerGraph.Unfollow(follower, followed)
+}
+
+//The new graph is snapshotted before it replaces the one in memory,
+//so the graph is left as it was if the snapshot fails
+func (fg *fileFollowerGraph) Replace(follows map[int][]int) error {
+	replacement := NewMemoryFollowerGraph().(*memoryFollowerGraph)
+	replacement.Replace(follows)
+	if err := fg.snapshot(replacement); err != nil {
+		return err
+	}
+	fg.memoryFollowerGraph.follows = replacement.follows
+	return nil
+}
+
+func (fg *fileFollowerGraph) MarkApplied(sequence int) error {
+	if sequence == fg.applied {
+		return nil
+	}
+	if err := fg.journal.append("A|" + strconv.Itoa(sequence)); err != nil {
+		return err
+	}
+	fg.applied = sequence
+	return nil
+}
+
+func (fg *fileFollowerGraph) Applied() int {
+	return fg.applied
+}
+
+//Parses an "A|sequence" line of the snapshot or journal
+func (fg *fileFollowerGraph) loadApplied(line string) error {
+	fields, err := splitRecord(line, 2)
+	if err != nil {
+		return err
+	}
+	seq, err := atoiFields(line, fields[1])
+	if err != nil {
+		return err
+	}
+	fg.applied = seq[0]
+	return nil
+}
+
+func (fg *fileFollowerGraph) Snapshot() error {
+	return fg.snapshot(fg.memoryFollowerGraph)
+}
+
+//Snapshots graph with the applied sequence number
+func (fg *fileFollowerGraph) snapshot(graph FollowerGraph) error {
+	return fg.journal.snapshot(func(w io.Writer) error {
+		if fg.applied >= 0 {
+			if _, err := io.WriteString(w, "A|"+strconv.Itoa(fg.applied)+"\n"); err != nil {
+				return err
+			}
+		}
+		return writeFollowerGraph(w, graph)
+	})
+}
+
+func (fg *fileFollowerGraph) Close() error {
+	return fg.journal.close()
+}
+
+//Writes the graph as one "followerId|followedId" line per follow, sorted
+func writeFollowerGraph(w io.Writer, graph FollowerGraph) error {
+	var lines []string
+	graph.Each(func(followed int, followers []int) {
+		for _, follower := range followers {
+			lines = append(lines, strconv.Itoa(follower)+"|"+strconv.Itoa(followed))
+		}
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Reads a graph written by writeFollowerGraph into a map of followed users to their followers
+func readFollowerGraph(r io.Reader) (map[int][]int, error) {
+	follows := make(map[int][]int)
+	err := readLines(r, func(line string) error {
+		follower, followed, err := parseFollow(line)
+		if err != nil {
+			return err
+		}
+		follows[followed] = append(follows[followed], follower)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return follows, nil
+}
+
+//Parses a "followerId|followedId" line
+func parseFollow(line string) (int, int, error) {
+	fields := strings.Split(line, "|")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid follow %q, expected followerId|followedId", line)
+	}
+	ids, err := atoiFields(line, fields...)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ids[0], ids[1], nil
+}
+
+//fileReorderBuffer keeps buffered events in memory and journals every put ("P|payload")
+//and take ("T|sequence"), the snapshot has one line per buffered event payload
+type fileReorderBuffer struct {
+	*memoryReorderBuffer
+	journal *journal
+}
+
+//Opens the ReorderBuffer stored in dir, creating it if needed
+//Snapshot writes the buffered events and clears the journal
+func OpenFileReorderBuffer(dir string, opts wal.Options) (ReorderBuffer, error) {
+	fb := &fileReorderBuffer{memoryReorderBuffer: NewMemoryReorderBuffer().(*memoryReorderBuffer)}
+	put := func(payload string) error {
+		event, err := ParseEvent(payload)
+		if err != nil {
+			return err
+		}
+		return fb.memoryReorderBuffer.Put(event)
+	}
+	var err error
+	fb.journal, err = openJournal(dir, opts, put, func(record string) error {
+		fields, err := splitRecord(record, 2)
+		if err != nil {
+			return err
+		}
+		switch fields[0] {
+		case "P":
+			return put(fields[1])
+		case "T":
+			seq, err := atoiFields(record, fields[1])
+			if err != nil {
+				return err
+			}
+			_, _, err = fb.memoryReorderBuffer.Take(seq[0])
+			return err
+		}
+		return fmt.Errorf("invalid reorder buffer record %q", record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fb, nil
+}
+
+func (fb *fileReorderBuffer) Put(event Event) error {
+	if err := fb.journal.append("P|" + event.payload); err != nil {
+		return err
+	}
+	return fb.memoryReorderBuffer.Put(event)
+}
+
+func (fb *fileReorderBuffer) Take(sequence int) (Event, bool, error) {
+	if _, ok := fb.events[sequence]; !ok {
+		return Event{}, false, nil
+	}
+	if err := fb.journal.append("T|" + strconv.Itoa(sequence)); err != nil {
+		return Event{}, false, err
+	}
+	return fb.memoryReorderBuffer.Take(sequence)
+}
+
+func (fb *fileReorderBuffer) Snapshot() error {
+	return fb.journal.snapshot(func(w io.Writer) error {
+		for _, event := range fb.events {
+			if _, err := io.WriteString(w, event.payload+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (fb *fileReorderBuffer) Close() error {
+	return fb.journal.close()
+}
+
+//filePendingEvents keeps undelivered events in memory and journals every push
+//("P|user|unixNanos|payload"), take ("T|user|unixNanos") and sweep that discarded
+//something ("S|unixNanos"), replaying them through the same limits
+//Events already pending for a user are ignored, so replaying the journal
+//over a newer snapshot, or replaying the event log, doesn't duplicate them
+//The snapshot has one "user|unixNanos|payload" line per pending event
+type filePendingEvents struct {
+	*memoryPendingEvents
+	journal *journal
+	//Sequence numbers of the events in each user's box
+	sequences map[int]map[int]bool
+}
+
+//Opens the PendingEvents stored in dir, creating it if needed, see NewMemoryPendingEvents for size and maxAge
+//Snapshot writes the pending events and clears the journal
+func OpenFilePendingEvents(dir string, size int, maxAge time.Duration, opts wal.Options) (PendingEvents, error) {
+	fp := &filePendingEvents{
+		memoryPendingEvents: NewMemoryPendingEvents(size, maxAge).(*memoryPendingEvents),
+		sequences:           make(map[int]map[int]bool),
+	}
+	push := func(record string, fields []string) error {
+		ints, err := atoiFields(record, fields[0], fields[1])
+		if err != nil {
+			return err
+		}
+		event, err := ParseEvent(fields[2])
+		if err != nil {
+			return err
+		}
+		if !fp.pending(ints[0], event.sequence) {
+			fp.push(ints[0], event, time.Unix(0, int64(ints[1])))
+		}
+		return nil
+	}
+	var err error
+	fp.journal, err = openJournal(dir, opts, func(line string) error {
+		fields, err := splitRecord(line, 3)
+		if err != nil {
+			return err
+		}
+		return push(line, fields)
+	}, func(record string) error {
+		fields, err := splitRecord(record, 2)
+		if err != nil {
+			return err
+		}
+		switch fields[0] {
+		case "P":
+			args, err := splitRecord(fields[1], 3)
+			if err != nil {
+				return err
+			}
+			return push(record, args)
+		case "T":
+			args, err := splitRecord(fields[1], 2)
+			if err != nil {
+				return err
+			}
+			ints, err := atoiFields(record, args...)
+			if err != nil {
+				return err
+			}
+			fp.take(ints[0], time.Unix(0, int64(ints[1])))
+			return nil
+		case "S":
+			ints, err := atoiFields(record, fields[1])
+			if err != nil {
+				return err
+			}
+			fp.sweep(time.Unix(0, int64(ints[0])))
+			return nil
+		}
+		return fmt.Errorf("invalid pending event record %q", record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (fp *filePendingEvents) Push(user int, event Event, now time.Time) (int, error) {
+	if fp.pending(user, event.sequence) {
+		return 0, nil
+	}
+	if err := fp.journal.append("P|" + strconv.Itoa(user) + "|" + strconv.FormatInt(now.UnixNano(), 10) + "|" + event.payload); err != nil {
+		return 0, err
+	}
+	return fp.push(user, event, now), nil
+}
+
+func (fp *filePendingEvents) Take(user int, now time.Time) ([]Event, int, error) {
+	if len(fp.boxes[user]) == 0 {
+		return nil, 0, nil
+	}
+	if err := fp.journal.append("T|" + strconv.Itoa(user) + "|" + strconv.FormatInt(now.UnixNano(), 10)); err != nil {
+		return nil, 0, err
+	}
+	events, dropped := fp.take(user, now)
+	return events, dropped, nil
+}
+
+//Expired events come back after a crash if the sweep couldn't be journaled,
+//the next sweep discards them again
+func (fp *filePendingEvents) Sweep(now time.Time) (int, error) {
+	dropped := fp.sweep(now)
+	if dropped == 0 {
+		return 0, nil
+	}
+	return dropped, fp.journal.append("S|" + strconv.FormatInt(now.UnixNano(), 10))
+}
+
+func (fp *filePendingEvents) Snapshot() error {
+	return fp.journal.snapshot(func(w io.Writer) error {
+		for user, box := range fp.boxes {
+			for _, entry := range box {
+				line := strconv.Itoa(user) + "|" + strconv.FormatInt(entry.stored.UnixNano(), 10) + "|" + entry.event.payload + "\n"
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (fp *filePendingEvents) Close() error {
+	return fp.journal.close()
+}
+
+//Returns true if the event with the sequence number is pending for the user
+func (fp *filePendingEvents) pending(user int, sequence int) bool {
+	return fp.sequences[user][sequence]
+}
+
+//The memory store operations, keeping the pending sequence numbers up to date
+//Boxes only ever lose their oldest events, which is how forget finds the ones that are gone
+
+func (fp *filePendingEvents) push(user int, event Event, now time.Time) int {
+	box := fp.boxes[user]
+	dropped, _ := fp.memoryPendingEvents.Push(user, event, now)
+	fp.forget(user, box, 1)
+	if fp.sequences[user] == nil {
+		fp.sequences[user] = make(map[int]bool)
+	}
+	fp.sequences[user][event.sequence] = true
+	return dropped
+}
+
+func (fp *filePendingEvents) take(user int, now time.Time) ([]Event, int) {
+	events, dropped, _ := fp.memoryPendingEvents.Take(user, now)
+	delete(fp.sequences, user)
+	return events, dropped
+}
+
+func (fp *filePendingEvents) sweep(now time.Time) int {
+	boxes := make(map[int][]pendingEntry, len(fp.boxes))
+	for user, box := range fp.boxes {
+		boxes[user] = box
+	}
+	dropped, _ := fp.memoryPendingEvents.Sweep(now)
+	if dropped > 0 {
+		for user, box := range boxes {
+			fp.forget(user, box, 0)
+		}
+	}
+	return dropped
+}
+
+//Forgets the sequence numbers of the oldest events of box, as it was before
+//added events were pushed, that are no longer in the user's box
+func (fp *filePendingEvents) forget(user int, box []pendingEntry, added int) {
+	removed := len(box) + added - len(fp.boxes[user])
+	for _, entry := range box[:removed] {
+		delete(fp.sequences[user], entry.event.sequence)
+	}
+	if len(fp.sequences[user]) == 0 {
+		delete(fp.sequences, user)
+	}
+}
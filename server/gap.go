@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/config"
+)
+
+//GapPolicy decides what the dispatcher does when the next expected
+//sequence number is missing while later events are already buffered
+type GapPolicy int
+
+const (
+	//Wait for the missing sequence forever (original behaviour)
+	GapWait GapPolicy = iota
+	//Skip the missing sequence(s) once the gap is older than GapTimeoutMs
+	GapSkipAfterTimeout
+	//Skip the missing sequence(s) once GapMaxBuffered events are waiting behind it
+	GapSkipAfterBuffered
+	//Disconnect all event sources once the gap is older than GapTimeoutMs
+	GapFailSource
+)
+
+var gapPolicies = map[string]GapPolicy{
+	"":             GapWait,
+	"WAIT":         GapWait,
+	"SKIP-TIMEOUT": GapSkipAfterTimeout,
+	"SKIP-BUFFER":  GapSkipAfterBuffered,
+	"FAIL":         GapFailSource,
+}
+
+//Parses the gap policy names used in conf.json
+//Valid options are "wait", "skip-timeout", "skip-buffer" and "fail"
+func ParseGapPolicy(policy string) (GapPolicy, error) {
+	if p, ok := gapPolicies[strings.ToUpper(policy)]; ok {
+		return p, nil
+	}
+	return GapWait, errors.New("INVALID GAP POLICY: " + policy)
+}
+
+//gapConfig is the dispatcher's view of the configured gap policy
+type gapConfig struct {
+	policy      GapPolicy
+	timeout     time.Duration
+	maxBuffered int
+}
+
+//Lets config.Load reject a bad gap policy before the server starts
+func init() {
+	config.AddCheck(func(conf config.ServerConfig) error {
+		_, err := newGapConfig(conf)
+		return err
+	})
+}
+
+func newGapConfig(conf config.ServerConfig) (gapConfig, error) {
+	policy, err := ParseGapPolicy(conf.GapPolicy)
+	if err != nil {
+		return gapConfig{}, err
+	}
+	gc := gapConfig{
+		policy:      policy,
+		timeout:     time.Duration(conf.GapTimeoutMs) * time.Millisecond,
+		maxBuffered: conf.GapMaxBuffered,
+	}
+	if (policy == GapSkipAfterTimeout || policy == GapFailSource) && gc.timeout <= 0 {
+		return gapConfig{}, errors.New("gap policy " + conf.GapPolicy + " requires a positive gapTimeoutMs")
+	}
+	if policy == GapSkipAfterBuffered && gc.maxBuffered <= 0 {
+		return gapConfig{}, errors.New("gap policy " + conf.GapPolicy + " requires a positive gapMaxBuffered")
+	}
+	//The reorder window holds at most maxReorderWindow-1 events behind a gap,
+	//more would never be buffered and the gap never skipped
+	if policy == GapSkipAfterBuffered && conf.MaxReorderWindow > 0 && gc.maxBuffered >= conf.MaxReorderWindow {
+		return gapConfig{}, errors.New("gap policy " + conf.GapPolicy + " requires gapMaxBuffered below maxReorderWindow")
+	}
+	return gc, nil
+}
+
+//Returns true if the policy needs a timer armed while a gap is open
+func (gc gapConfig) timed() bool {
+	return gc.policy == GapSkipAfterTimeout || gc.policy == GapFailSource
+}
+
+//eventSources keeps track of the connected event sources so the
+//dispatcher is able to fail them when a gap can't be closed,
+//and shutdown can wait for their handlers before draining the dispatcher
+type eventSources struct {
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	//Handlers of added sources that haven't returned yet
+	handlers sync.WaitGroup
+	//Set once the server stops, no source is added after
+	stopped bool
+}
+
+func newEventSources() *eventSources {
+	return &eventSources{conns: make(map[net.Conn]struct{})}
+}
+
+//Tracks the source until its handler calls remove
+//Returns false and closes the connection if the server is stopping
+func (es *eventSources) add(conn net.Conn) bool {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	if es.stopped {
+		conn.Close()
+		return false
+	}
+	es.conns[conn] = struct{}{}
+	es.handlers.Add(1)
+	return true
+}
+
+//Called by the handler of an added source when it returns
+func (es *eventSources) remove(conn net.Conn) {
+	es.mutex.Lock()
+	delete(es.conns, conn)
+	es.mutex.Unlock()
+	es.handlers.Done()
+}
+
+//Returns the remote addresses of the connected event sources
+func (es *eventSources) addrs() []string {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	addrs := make([]string, 0, len(es.conns))
+	for conn := range es.conns {
+		addrs = append(addrs, conn.RemoteAddr().String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//Closes every connected event source and returns how many were closed
+func (es *eventSources) closeAll() int {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	n := len(es.conns)
+	for conn := range es.conns {
+		conn.Close()
+		delete(es.conns, conn)
+	}
+	return n
+}
+
+//Closes every connected event source for good and waits for their handlers to return,
+//after which no more events are handed to the dispatcher
+func (es *eventSources) stop() {
+	es.mutex.Lock()
+	es.stopped = true
+	es.mutex.Unlock()
+	es.closeAll()
+	es.handlers.Wait()
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+//historyEntry is a dispatched event together with the users it was addressed to
+//Broadcasts are addressed to everyone and have no recipient list
+type historyEntry struct {
+	event      Event
+	recipients []int
+	broadcast  bool
+}
+
+//history retains the last size dispatched events in a ring so reconnecting
+//clients can ask for everything they missed after a given sequence number
+//Recorded by the dispatcher goroutine and read by the shards of resuming users
+type history struct {
+	mutex   sync.Mutex
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func newHistory(size int) *history {
+	return &history{entries: make([]historyEntry, size)}
+}
+
+//Records a dispatched event, overwriting the oldest one once the ring is full
+func (h *history) record(event Event, recipients []int, broadcast bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries[h.next] = historyEntry{event, recipients, broadcast}
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+//Returns the retained events addressed to the user with a sequence after seq,
+//in sequence order, and whether the history reaches back far enough to be complete
+func (h *history) since(userId int, seq int) ([]Event, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var events []Event
+	oldest := -1
+	for i := 0; i < h.len(); i++ {
+		entry := h.entries[(h.start()+i)%len(h.entries)]
+		if oldest == -1 {
+			oldest = entry.event.sequence
+		}
+		if entry.event.sequence <= seq || !entry.addressedTo(userId) {
+			continue
+		}
+		events = append(events, entry.event)
+	}
+	return events, !h.full || oldest <= seq+1
+}
+
+func (h *history) len() int {
+	if h.full {
+		return len(h.entries)
+	}
+	return h.next
+}
+
+func (h *history) start() int {
+	if h.full {
+		return h.next
+	}
+	return 0
+}
+
+func (he historyEntry) addressedTo(userId int) bool {
+	if he.broadcast {
+		return true
+	}
+	for _, r := range he.recipients {
+		if r == userId {
+			return true
+		}
+	}
+	return false
+}
+
+//Merges event lists into a single list in sequence order without duplicates
+func mergeEvents(lists ...[]Event) []Event {
+	seen := make(map[int]bool)
+	var merged []Event
+	for _, list := range lists {
+		for _, event := range list {
+			if !seen[event.sequence] {
+				seen[event.sequence] = true
+				merged = append(merged, event)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].sequence < merged[j].sequence })
+	return merged
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//mailbox keeps events addressed to users that aren't connected in a PendingEvents store,
+//publishing its depth and the events it discards to Stats
+//Boxes are flushed in the order events were pushed once the user connects
+//Shared by every shard, the mutex keeps the store from being called concurrently
+type mailbox struct {
+	mutex sync.Mutex
+	store PendingEvents
+	stats *Stats
+	log   Logger
+}
+
+func newMailbox(store PendingEvents, stats *Stats, log Logger) *mailbox {
+	return &mailbox{store: store, stats: stats, log: log}
+}
+
+//Stores the event for the user, the store decides what to discard when the box is full
+func (mb *mailbox) push(userId int, event Event, now time.Time) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	dropped, err := mb.store.Push(userId, event, now)
+	if err != nil {
+		mb.log.Error("Unable to store event ", event.payload, " for user ", userId, " ", err)
+	}
+	if dropped > 0 {
+		mb.log.Debug("Mailbox of user ", userId, " discarded ", dropped, " events")
+	}
+	mb.count(dropped)
+}
+
+//Removes and returns every unexpired event stored for the user
+func (mb *mailbox) take(userId int, now time.Time) []Event {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	events, dropped, err := mb.store.Take(userId, now)
+	if err != nil {
+		mb.log.Error("Unable to take stored events of user ", userId, " ", err)
+	}
+	mb.count(dropped)
+	return events
+}
+
+//Discards expired events from every box
+func (mb *mailbox) sweep(now time.Time) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	dropped, err := mb.store.Sweep(now)
+	if err != nil {
+		mb.log.Error("Unable to expire stored events ", err)
+	}
+	mb.count(dropped)
+}
+
+func (mb *mailbox) count(dropped int) {
+	atomic.AddInt64(&mb.stats.mailboxDropped, int64(dropped))
+	atomic.StoreInt64(&mb.stats.mailboxDepth, int64(mb.store.Len()))
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"time"
+)
+
+//memoryFollowerGraph keeps the follower graph in a map of followed users to their followers
+type memoryFollowerGraph struct {
+	follows map[int]map[int]bool
+}
+
+//Returns a FollowerGraph held in memory, lost when the process exits
+func NewMemoryFollowerGraph() FollowerGraph {
+	return &memoryFollowerGraph{follows: make(map[int]map[int]bool)}
+}
+
+func (mg *memoryFollowerGraph) Follow(follower int, followed int) error {
+	followers, ok := mg.follows[followed]
+	if !ok {
+		followers = make(map[int]bool)
+		mg.follows[followed] = followers
+	}
+	followers[follower] = true
+	return nil
+}
+
+func (mg *memoryFollowerGraph) Unfollow(follower int, followed int) error {
+	followers := mg.follows[followed]
+	delete(followers, follower)
+	if len(followers) == 0 {
+		delete(mg.follows, followed)
+	}
+	return nil
+}
+
+func (mg *memoryFollowerGraph) Followers(user int) []int {
+	followers := make([]int, 0, len(mg.follows[user]))
+	for follower := range mg.follows[user] {
+		followers = append(followers, follower)
+	}
+	return followers
+}
+
+func (mg *memoryFollowerGraph) Each(fn func(followed int, followers []int)) {
+	for followed := range mg.follows {
+		fn(followed, mg.Followers(followed))
+	}
+}
+
+func (mg *memoryFollowerGraph) Replace(follows map[int][]int) error {
+	mg.follows = make(map[int]map[int]bool)
+	for followed, followers := range follows {
+		for _, follower := range followers {
+			mg.Follow(follower, followed)
+		}
+	}
+	return nil
+}
+
+func (mg *memoryFollowerGraph) Close() error {
+	return nil
+}
+
+//memoryReorderBuffer keeps buffered events in a map keyed by sequence number
+type memoryReorderBuffer struct {
+	events map[int]Event
+}
+
+//Returns a ReorderBuffer held in memory
+func NewMemoryReorderBuffer() ReorderBuffer {
+	return &memoryReorderBuffer{events: make(map[int]Event)}
+}
+
+func (mb *memoryReorderBuffer) Put(event Event) error {
+	mb.events[event.sequence] = event
+	return nil
+}
+
+func (mb *memoryReorderBuffer) Take(sequence int) (Event, bool, error) {
+	event, ok := mb.events[sequence]
+	if ok {
+		delete(mb.events, sequence)
+	}
+	return event, ok, nil
+}
+
+func (mb *memoryReorderBuffer) Lowest() (int, bool) {
+	lowest, found := 0, false
+	for seq := range mb.events {
+		if !found || seq < lowest {
+			lowest, found = seq, true
+		}
+	}
+	return lowest, found
+}
+
+func (mb *memoryReorderBuffer) Len() int {
+	return len(mb.events)
+}
+
+func (mb *memoryReorderBuffer) Close() error {
+	return nil
+}
+
+//pendingEntry is an undelivered event and the time it was stored
+type pendingEntry struct {
+	event  Event
+	stored time.Time
+}
+
+//memoryPendingEvents keeps each user's undelivered events in a slice in push order
+//Each user's box holds at most size events (oldest are dropped first)
+//and events older than maxAge are discarded
+type memoryPendingEvents struct {
+	size   int
+	maxAge time.Duration
+	boxes  map[int][]pendingEntry
+	depth  int
+}
+
+//Returns PendingEvents held in memory keeping at most size events per user for up to maxAge
+//A size of zero means unlimited, a maxAge of zero keeps events until the box overflows
+func NewMemoryPendingEvents(size int, maxAge time.Duration) PendingEvents {
+	return &memoryPendingEvents{size: size, maxAge: maxAge, boxes: make(map[int][]pendingEntry)}
+}
+
+func (mp *memoryPendingEvents) Push(user int, event Event, now time.Time) (int, error) {
+	box, dropped := mp.expire(user, now)
+	if mp.size > 0 && len(box) >= mp.size {
+		box = box[1:]
+		mp.depth--
+		dropped++
+	}
+	mp.boxes[user] = append(box, pendingEntry{event, now})
+	mp.depth++
+	return dropped, nil
+}
+
+func (mp *memoryPendingEvents) Take(user int, now time.Time) ([]Event, int, error) {
+	box, dropped := mp.expire(user, now)
+	if len(box) == 0 {
+		return nil, dropped, nil
+	}
+	delete(mp.boxes, user)
+	mp.depth -= len(box)
+	events := make([]Event, len(box))
+	for i, entry := range box {
+		events[i] = entry.event
+	}
+	return events, dropped, nil
+}
+
+func (mp *memoryPendingEvents) Sweep(now time.Time) (int, error) {
+	dropped := 0
+	for user := range mp.boxes {
+		_, expired := mp.expire(user, now)
+		dropped += expired
+	}
+	return dropped, nil
+}
+
+func (mp *memoryPendingEvents) Len() int {
+	return mp.depth
+}
+
+func (mp *memoryPendingEvents) Close() error {
+	return nil
+}
+
+//Discards the user's expired events and returns what is left and how many were discarded
+func (mp *memoryPendingEvents) expire(user int, now time.Time) ([]pendingEntry, int) {
+	box := mp.boxes[user]
+	expired := 0
+	for mp.maxAge > 0 && expired < len(box) && now.Sub(box[expired].stored) > mp.maxAge {
+		expired++
+	}
+	if expired == 0 {
+		return box, 0
+	}
+	mp.depth -= expired
+	box = box[expired:]
+	if len(box) == 0 {
+		delete(mp.boxes, user)
+	} else {
+		mp.boxes[user] = box
+	}
+	return box, expired
+}
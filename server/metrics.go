@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/logger"
+)
+
+//Bucket upper bounds of the receive to write latency histogram, in seconds
+var dispatchLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//Bucket upper bounds of the number of users a "B" or "S" event reaches
+var fanoutBuckets = []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 10000}
+
+//Event types counted under their own label, anything else an event source sends is counted as "unknown"
+//so a misbehaving source can't create a label per message
+var eventTypeLabels = map[string]bool{"F": true, "U": true, "B": true, "P": true, "S": true}
+
+func eventTypeLabel(eventType string) string {
+	if eventTypeLabels[eventType] {
+		return eventType
+	}
+	return "unknown"
+}
+
+//counterVec is a set of counters told apart by the value of a single label
+//Labels must come from a small fixed set
+//The zero value is ready to use
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+func (cv *counterVec) inc(label string) {
+	cv.mutex.Lock()
+	if cv.values == nil {
+		cv.values = make(map[string]int64)
+	}
+	cv.values[label]++
+	cv.mutex.Unlock()
+}
+
+func (cv *counterVec) get(label string) int64 {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	return cv.values[label]
+}
+
+//Returns a copy of the counters sorted by label
+func (cv *counterVec) snapshot() ([]string, []int64) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	labels := make([]string, 0, len(cv.values))
+	for label := range cv.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	values := make([]int64, len(labels))
+	for i, label := range labels {
+		values[i] = cv.values[label]
+	}
+	return labels, values
+}
+
+//Number of users whose write errors are counted on their own
+const trackedWriteErrorUsers = 1000
+
+//Number of users with the most write errors exported with a user label
+const exportedWriteErrorUsers = 10
+
+//userCounter counts per user for a bounded number of users
+//Once max users are tracked a new user replaces the one with the lowest count,
+//so the users with the most counts stay tracked while the number of users seen is unbounded
+type userCounter struct {
+	mutex  sync.Mutex
+	max    int
+	values map[int]int64
+}
+
+func newUserCounter(max int) *userCounter {
+	return &userCounter{max: max, values: make(map[int]int64)}
+}
+
+func (uc *userCounter) inc(userId int) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	if _, ok := uc.values[userId]; !ok && len(uc.values) >= uc.max {
+		lowest := -1
+		for id, value := range uc.values {
+			if lowest == -1 || value < uc.values[lowest] {
+				lowest = id
+			}
+		}
+		delete(uc.values, lowest)
+	}
+	uc.values[userId]++
+}
+
+func (uc *userCounter) get(userId int) int64 {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	return uc.values[userId]
+}
+
+//Returns the n users with the highest counts, highest first
+func (uc *userCounter) top(n int) ([]int, []int64) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	users := make([]int, 0, len(uc.values))
+	for userId := range uc.values {
+		users = append(users, userId)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if uc.values[users[i]] != uc.values[users[j]] {
+			return uc.values[users[i]] > uc.values[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	if len(users) > n {
+		users = users[:n]
+	}
+	values := make([]int64, len(users))
+	for i, userId := range users {
+		values[i] = uc.values[userId]
+	}
+	return users, values
+}
+
+//histogram counts observations into fixed buckets without taking a lock
+//Every observation is counted in its lowest bucket only, snapshot adds them up
+type histogram struct {
+	bounds []float64
+	//One more than bounds, the last for observations above every bound
+	counts []uint64
+	//math.Float64bits of the sum of observations
+	sumBits uint64
+	count   uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+//The total count is incremented before the bucket, so a snapshot never has a bucket above it
+func (h *histogram) observe(v float64) {
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.bounds, v)], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) observeSince(start time.Time) {
+	h.observe(time.Since(start).Seconds())
+}
+
+//Cumulative bucket counts, sum and total count
+//Observations made while taking the snapshot may only be partly included
+func (h *histogram) snapshot() ([]uint64, float64, uint64) {
+	cumulative := make([]uint64, len(h.bounds))
+	var total uint64
+	for i := range cumulative {
+		total += atomic.LoadUint64(&h.counts[i])
+		cumulative[i] = total
+	}
+	sum := math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+	return cumulative, sum, atomic.LoadUint64(&h.count)
+}
+
+//histogramVec is a set of histograms told apart by the value of a single label
+type histogramVec struct {
+	mutex  sync.RWMutex
+	bounds []float64
+	hists  map[string]*histogram
+}
+
+func newHistogramVec(bounds []float64) *histogramVec {
+	return &histogramVec{bounds: bounds, hists: make(map[string]*histogram)}
+}
+
+func (hv *histogramVec) with(label string) *histogram {
+	hv.mutex.RLock()
+	h, ok := hv.hists[label]
+	hv.mutex.RUnlock()
+	if ok {
+		return h
+	}
+	hv.mutex.Lock()
+	defer hv.mutex.Unlock()
+	h, ok = hv.hists[label]
+	if !ok {
+		h = newHistogram(hv.bounds)
+		hv.hists[label] = h
+	}
+	return h
+}
+
+func (hv *histogramVec) labels() []string {
+	hv.mutex.RLock()
+	defer hv.mutex.RUnlock()
+	labels := make([]string, 0, len(hv.hists))
+	for label := range hv.hists {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+//metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	mw.w.WriteString("# HELP " + name + " " + help + "\n")
+	mw.w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (mw metricsWriter) sample(name, labels string, value string) {
+	mw.w.WriteString(name)
+	if labels != "" {
+		mw.w.WriteString("{" + labels + "}")
+	}
+	mw.w.WriteString(" " + value + "\n")
+}
+
+func (mw metricsWriter) single(name, kind, help string, value int64) {
+	mw.header(name, kind, help)
+	mw.sample(name, "", strconv.FormatInt(value, 10))
+}
+
+func (mw metricsWriter) counterVec(name, help, label string, cv *counterVec) {
+	mw.header(name, "counter", help)
+	labels, values := cv.snapshot()
+	for i := range labels {
+		mw.sample(name, label+"="+labelValue(labels[i]), strconv.FormatInt(values[i], 10))
+	}
+}
+
+func (mw metricsWriter) topUsers(name, help string, uc *userCounter, n int) {
+	mw.header(name, "counter", help)
+	users, values := uc.top(n)
+	for i := range users {
+		mw.sample(name, "user="+labelValue(strconv.Itoa(users[i])), strconv.FormatInt(values[i], 10))
+	}
+}
+
+func (mw metricsWriter) histogram(name, labels string, h *histogram) {
+	counts, sum, count := h.snapshot()
+	if labels != "" {
+		labels += ","
+	}
+	for i, bound := range h.bounds {
+		mw.sample(name+"_bucket", labels+`le="`+formatFloat(bound)+`"`, strconv.FormatUint(counts[i], 10))
+	}
+	mw.sample(name+"_bucket", labels+`le="+Inf"`, strconv.FormatUint(count, 10))
+	labels = trimComma(labels)
+	mw.sample(name+"_sum", labels, formatFloat(sum))
+	mw.sample(name+"_count", labels, strconv.FormatUint(count, 10))
+}
+
+func (mw metricsWriter) histogramVec(name, help, label string, hv *histogramVec) {
+	mw.header(name, "histogram", help)
+	for _, value := range hv.labels() {
+		mw.histogram(name, label+"="+labelValue(value), hv.with(value))
+	}
+}
+
+//Prometheus only escapes backslashes, double quotes and line feeds in label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//Quotes a label value the way the Prometheus text format expects
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func trimComma(labels string) string {
+	if len(labels) > 0 && labels[len(labels)-1] == ',' {
+		return labels[:len(labels)-1]
+	}
+	return labels
+}
+
+//Writes every metric in the Prometheus text exposition format
+func (st *Stats) WritePrometheus(w io.Writer) error {
+	mw := metricsWriter{bufio.NewWriter(w)}
+	mw.counterVec("followermaze_events_received_total", "Events read from event sources by event type.", "type", &st.eventsReceived)
+	mw.counterVec("followermaze_parse_failures_total", "Messages that couldn't be parsed by connection kind.", "source", &st.parseFailures)
+	mw.single("followermaze_next_sequence", "gauge", "Next sequence number the dispatcher expects.", st.NextSequence())
+	mw.single("followermaze_reorder_buffer_depth", "gauge", "Events buffered while waiting for a missing sequence number.", st.ReorderDepth())
+	mw.single("followermaze_reorder_stalls_total", "counter", "Times an event source was paused because the reorder window was full.", st.ReorderStalls())
+	mw.single("followermaze_skipped_sequences_total", "counter", "Sequence numbers the gap policy gave up waiting for.", st.SkippedSequences())
+	mw.single("followermaze_connected_users", "gauge", "Users with at least one live session.", st.ConnectedUsers())
+	mw.single("followermaze_connected_sessions", "gauge", "Live user sessions.", st.ConnectedSessions())
+	mw.single("followermaze_user_write_errors_total", "counter", "Failed writes to user clients.", st.UserWriteErrors())
+	mw.topUsers("followermaze_top_user_write_errors_total", "Failed writes to the user clients with the most failures by user ID.", st.writeErrorsByUser, exportedWriteErrorUsers)
+	mw.single("followermaze_dropped_events_total", "counter", "Events discarded because a user's queue was full.", st.DroppedEvents())
+	mw.single("followermaze_slow_consumer_disconnects_total", "counter", "Users disconnected because their queue was full.", st.SlowConsumerDisconnects())
+	mw.single("followermaze_mailbox_depth", "gauge", "Undelivered events held in offline mailboxes.", st.MailboxDepth())
+	mw.single("followermaze_mailbox_dropped_total", "counter", "Mailbox events discarded because a box was full or the event expired.", st.MailboxDropped())
+	mw.single("followermaze_log_dropped_total", "counter", "Log messages discarded because the asynchronous log buffer was full.", logger.Dropped())
+	mw.header("followermaze_dispatch_latency_seconds", "histogram", "Time from reading an event to writing it to a user.")
+	mw.histogram("followermaze_dispatch_latency_seconds", "", st.dispatchLatency)
+	mw.histogramVec("followermaze_fanout_users", "Users reached by a broadcast or status update by event type.", "type", st.fanout)
+	return mw.w.Flush()
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/config"
+	"github.com/sahilahmadlone/MessagingSocketServer/logger"
+)
+
+//Logger is what the server logs through
+//By default messages go to the logger package, embedding applications
+//can plug in their own implementation with WithLogger
+type Logger interface {
+	Debug(m ...interface{})
+	Info(m ...interface{})
+	Warn(m ...interface{})
+	Error(m ...interface{})
+}
+
+//packageLogger forwards to the logger package, reporting the server code
+//calling it rather than itself as the caller
+type packageLogger struct{}
+
+func (packageLogger) Debug(m ...interface{}) { logger.Output(2, "DEBUG", m...) }
+func (packageLogger) Info(m ...interface{})  { logger.Output(2, "INFO", m...) }
+func (packageLogger) Warn(m ...interface{})  { logger.Output(2, "WARN", m...) }
+func (packageLogger) Error(m ...interface{}) { logger.Output(2, "ERROR", m...) }
+
+//Changes the level of the logger package, used by the admin API
+func (packageLogger) SetLevel(level string) error { return logger.SetLevel(level) }
+
+//Option configures a Server created with New
+type Option func(*Server)
+
+//Sets the server configuration, config.Defaults() is used otherwise
+func WithConfig(conf config.ServerConfig) Option {
+	return func(ms *Server) {
+		ms.conf = conf
+	}
+}
+
+//Serves events on an already bound listener instead of EventListenerPort
+func WithEventListener(listener net.Listener) Option {
+	return func(ms *Server) {
+		ms.EListener = listener
+	}
+}
+
+//Serves user clients on an already bound listener instead of ClientListenerPort
+func WithUserListener(listener net.Listener) Option {
+	return func(ms *Server) {
+		ms.UListener = listener
+	}
+}
+
+//Stores the follower graph in graph instead of the default store, see storage.go
+func WithFollowerGraph(graph FollowerGraph) Option {
+	return func(ms *Server) {
+		ms.followers = graph
+	}
+}
+
+//Buffers out of order events in buffer instead of memory
+func WithReorderBuffer(buffer ReorderBuffer) Option {
+	return func(ms *Server) {
+		ms.reorder = buffer
+	}
+}
+
+//Keeps events for users that aren't connected in pending, enabling the offline mailbox
+//even without MailboxSize, whose limits are then up to pending
+func WithPendingEvents(pending PendingEvents) Option {
+	return func(ms *Server) {
+		ms.pending = pending
+	}
+}
+
+//Serves the admin API on an already bound listener instead of AdminListenerPort
+func WithAdminListener(listener net.Listener) Option {
+	return func(ms *Server) {
+		ms.AListener = listener
+	}
+}
+
+//Shuts the server down once ctx is cancelled
+func WithContext(ctx context.Context) Option {
+	return func(ms *Server) {
+		ms.ctx = ctx
+	}
+}
+
+//Logs through l instead of the logger package
+func WithLogger(l Logger) Option {
+	return func(ms *Server) {
+		ms.log = l
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+//FollowerQuery answers questions about the follower graph of a running server
+//Every call reads a consistent snapshot of the graph, as it was after some dispatched event,
+//pages of the same list taken by separate calls may come from different snapshots
+type FollowerQuery interface {
+	//Users following user, sorted by user ID
+	Followers(user int, offset int, limit int) UserPage
+	//Users that user follows, sorted by user ID
+	Followees(user int, offset int, limit int) UserPage
+	//Number of followers and followees of user
+	Counts(user int) UserCounts
+	//Whether follower follows followed
+	Follows(follower int, followed int) bool
+	//Whether a and b follow each other
+	Mutual(a int, b int) bool
+	//Every user with at least one follower or followee, sorted by user ID
+	Users(offset int, limit int) CountsPage
+}
+
+//UserPage is a page of a list of user IDs
+type UserPage struct {
+	Users []int `json:"users"`
+	//Length of the whole list
+	Total int `json:"total"`
+	//Offset of the first user of the page
+	Offset int `json:"offset"`
+}
+
+//UserCounts is the number of followers and followees of a user
+type UserCounts struct {
+	UserId    int `json:"userId"`
+	Followers int `json:"followers"`
+	Followees int `json:"followees"`
+}
+
+//CountsPage is a page of a list of users with their follower counts
+type CountsPage struct {
+	Users  []UserCounts `json:"users"`
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+}
+
+//Number of pending changes after which the replica catches up in the background
+const replicaCatchUp = 1024
+
+//graphChange is a follow, an unfollow or, with reset set, a whole new graph
+type graphChange struct {
+	follow   bool
+	follower int
+	followed int
+	reset    map[int][]int
+}
+
+//followerReplica is a copy of the follower graph indexed both ways for answering queries
+//The dispatcher only appends the changes it makes to the graph to a pending list,
+//queries apply them to the copy before reading it, so they never hold up the dispatcher
+//Once enough changes are pending they are applied in the background
+type followerReplica struct {
+	pendingMutex sync.Mutex
+	pending      []graphChange
+	catchingUp   bool
+	mutex        sync.RWMutex
+	followers    map[int]map[int]bool
+	followees    map[int]map[int]bool
+}
+
+func newFollowerReplica() *followerReplica {
+	return &followerReplica{followers: make(map[int]map[int]bool), followees: make(map[int]map[int]bool)}
+}
+
+//Records a change made by the dispatcher, never waits for queries
+func (fr *followerReplica) record(change graphChange) {
+	fr.pendingMutex.Lock()
+	fr.pending = append(fr.pending, change)
+	start := len(fr.pending) >= replicaCatchUp && !fr.catchingUp
+	if start {
+		fr.catchingUp = true
+	}
+	fr.pendingMutex.Unlock()
+	if start {
+		go func() {
+			fr.mutex.Lock()
+			fr.apply()
+			fr.mutex.Unlock()
+		}()
+	}
+}
+
+//Records the whole graph, e.g. after it was loaded or imported
+func (fr *followerReplica) reset(graph FollowerGraph) {
+	follows := make(map[int][]int)
+	graph.Each(func(followed int, followers []int) {
+		follows[followed] = append([]int(nil), followers...)
+	})
+	fr.record(graphChange{reset: follows})
+}
+
+//Applies the pending changes, must be called with the mutex held for writing
+func (fr *followerReplica) apply() {
+	fr.pendingMutex.Lock()
+	pending := fr.pending
+	fr.pending = nil
+	fr.catchingUp = false
+	fr.pendingMutex.Unlock()
+	for _, change := range pending {
+		switch {
+		case change.reset != nil:
+			fr.followers = make(map[int]map[int]bool)
+			fr.followees = make(map[int]map[int]bool)
+			for followed, followers := range change.reset {
+				for _, follower := range followers {
+					link(fr.followers, followed, follower)
+					link(fr.followees, follower, followed)
+				}
+			}
+		case change.follow:
+			link(fr.followers, change.followed, change.follower)
+			link(fr.followees, change.follower, change.followed)
+		default:
+			unlink(fr.followers, change.followed, change.follower)
+			unlink(fr.followees, change.follower, change.followed)
+		}
+	}
+}
+
+//Brings the replica up to date and returns holding the read lock
+func (fr *followerReplica) read() {
+	fr.mutex.Lock()
+	fr.apply()
+	fr.mutex.Unlock()
+	fr.mutex.RLock()
+}
+
+func (fr *followerReplica) Followers(user int, offset int, limit int) UserPage {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	return page(fr.followers[user], offset, limit)
+}
+
+func (fr *followerReplica) Followees(user int, offset int, limit int) UserPage {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	return page(fr.followees[user], offset, limit)
+}
+
+func (fr *followerReplica) Counts(user int) UserCounts {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	return UserCounts{user, len(fr.followers[user]), len(fr.followees[user])}
+}
+
+func (fr *followerReplica) Follows(follower int, followed int) bool {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	return fr.followers[followed][follower]
+}
+
+func (fr *followerReplica) Mutual(a int, b int) bool {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	return fr.followers[a][b] && fr.followers[b][a]
+}
+
+func (fr *followerReplica) Users(offset int, limit int) CountsPage {
+	fr.read()
+	defer fr.mutex.RUnlock()
+	users := make(map[int]bool, len(fr.followers)+len(fr.followees))
+	for user := range fr.followers {
+		users[user] = true
+	}
+	for user := range fr.followees {
+		users[user] = true
+	}
+	ids := page(users, offset, limit)
+	counts := CountsPage{Users: make([]UserCounts, len(ids.Users)), Total: ids.Total, Offset: ids.Offset}
+	for i, user := range ids.Users {
+		counts.Users[i] = UserCounts{user, len(fr.followers[user]), len(fr.followees[user])}
+	}
+	return counts
+}
+
+//Returns limit users of the set starting at offset, in ascending order
+func page(set map[int]bool, offset int, limit int) UserPage {
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	end := len(ids)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return UserPage{Users: ids[offset:end], Total: len(ids), Offset: offset}
+}
+
+func link(index map[int]map[int]bool, from int, to int) {
+	set, ok := index[from]
+	if !ok {
+		set = make(map[int]bool)
+		index[from] = set
+	}
+	set[to] = true
+}
+
+func unlink(index map[int]map[int]bool, from int, to int) {
+	delete(index[from], to)
+	if len(index[from]) == 0 {
+		delete(index, from)
+	}
+}
+
+//Returns the queries over the follower graph, they never wait for the dispatcher
+func (ms *Server) FollowerQuery() FollowerQuery {
+	return ms.replica
+}
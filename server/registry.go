@@ -0,0 +1,162 @@
+package server
+
+import "time"
+
+//userRegistry tracks every live session of every connected user
+//Users may be connected more than once (phone plus desktop),
+//events for a user are fanned out to all of its sessions
+//Events for users that aren't connected go to the offline mailbox (if enabled)
+//Each shard has its own registry for its users, see shard.go
+//Only ever used from the goroutine of its shard
+type userRegistry struct {
+	sessions map[int][]*userSession
+	live     int
+	conf     sessionConfig
+	mailbox  *mailbox
+	history  *history
+	log      Logger
+	//Sequence number of the last event handed to the registry
+	processed int
+}
+
+//A nil mailbox disables offline delivery, a nil history disables resume replay
+func newUserRegistry(conf sessionConfig, mailbox *mailbox, history *history, log Logger) *userRegistry {
+	return &userRegistry{sessions: make(map[int][]*userSession), conf: conf, mailbox: mailbox, history: history, log: log}
+}
+
+//Registers a new session, applying the per user session limit
+//and preloading the user's offline mailbox into it
+//Sessions resuming from a sequence number are preloaded with every retained
+//event addressed to the user after that sequence instead
+//Must be called before the session's writer is started
+//Returns false if the session was rejected
+func (ur *userRegistry) add(session *userSession) bool {
+	live := ur.sessions[session.userId]
+	if ur.conf.maxPerUser > 0 && len(live) >= ur.conf.maxPerUser {
+		if ur.conf.eviction == RejectNew {
+			ur.log.Warn("User ", session.userId, " already has ", len(live), " sessions, rejecting new session")
+			session.close()
+			return false
+		}
+		evicted := len(live) - ur.conf.maxPerUser + 1
+		for _, old := range live[:evicted] {
+			ur.log.Warn("User ", session.userId, " has too many sessions, evicting oldest session")
+			old.close()
+		}
+		live = live[evicted:]
+		ur.live -= evicted
+	}
+	ur.sessions[session.userId] = append(live, session)
+	ur.live++
+	var missed []Event
+	if ur.mailbox != nil {
+		missed = ur.mailbox.take(session.userId, time.Now())
+	}
+	if session.resume {
+		missed = ur.missedSince(session.userId, session.lastSeen, missed)
+	}
+	session.preload(missed)
+	return true
+}
+
+//Returns the events after lastSeen for the user from the mailbox and the history
+//The dispatcher records events in the history before handing them to the shard,
+//retained events the registry hasn't been handed yet are left for the new session to receive
+func (ur *userRegistry) missedSince(userId int, lastSeen int, mailboxed []Event) []Event {
+	var unseen []Event
+	for _, event := range mailboxed {
+		if event.sequence > lastSeen {
+			unseen = append(unseen, event)
+		}
+	}
+	if ur.history == nil {
+		return unseen
+	}
+	retained, complete := ur.history.since(userId, lastSeen)
+	if !complete {
+		ur.log.Warn("History doesn't reach back to sequence ", lastSeen, " for user ", userId, ", some events may be missing")
+	}
+	for len(retained) > 0 && retained[len(retained)-1].sequence > ur.processed {
+		retained = retained[:len(retained)-1]
+	}
+	ur.log.Debug("Resuming user ", userId, " after sequence ", lastSeen, " with ", len(retained), " retained events")
+	return mergeEvents(unseen, retained)
+}
+
+//Queues the event for every listed user
+func (ur *userRegistry) deliver(event Event, recipients ...int) {
+	ur.processed = event.sequence
+	for _, userId := range recipients {
+		ur.notify(event, userId)
+	}
+}
+
+//Forgets the session, returns false if it wasn't registered
+func (ur *userRegistry) remove(session *userSession) bool {
+	live := ur.sessions[session.userId]
+	for i, s := range live {
+		if s == session {
+			live = append(live[:i:i], live[i+1:]...)
+			ur.live--
+			if len(live) == 0 {
+				delete(ur.sessions, session.userId)
+			} else {
+				ur.sessions[session.userId] = live
+			}
+			return true
+		}
+	}
+	return false
+}
+
+//Queues the event for every session of the user
+//Sessions that were closed (e.g. by the slow consumer policy) are forgotten
+//If no session took the event it is kept in the user's mailbox
+func (ur *userRegistry) notify(event Event, userId int) {
+	delivered := false
+	for _, session := range ur.sessions[userId] {
+		if session.enqueue(event) {
+			delivered = true
+		} else {
+			ur.remove(session)
+		}
+	}
+	if !delivered && ur.mailbox != nil {
+		ur.mailbox.push(userId, event, time.Now())
+	}
+}
+
+//Queues the event for every session of every connected user
+//Returns the number of users the event was queued for
+func (ur *userRegistry) broadcast(event Event) int {
+	ur.processed = event.sequence
+	users := len(ur.sessions)
+	for userId := range ur.sessions {
+		ur.notify(event, userId)
+	}
+	return users
+}
+
+//Returns every live session
+func (ur *userRegistry) all() []*userSession {
+	var all []*userSession
+	for _, live := range ur.sessions {
+		all = append(all, live...)
+	}
+	return all
+}
+
+//Returns the live sessions of a user
+func (ur *userRegistry) get(userId int) []*userSession {
+	return ur.sessions[userId]
+}
+
+//Number of distinct connected users
+func (ur *userRegistry) users() int {
+	return len(ur.sessions)
+}
+
+//Number of live sessions across all users
+func (ur *userRegistry) count() int {
+	return ur.live
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/sahilahmadlone/MessagingSocketServer/config"
+)
+
+//Applies the settings of conf that can change while the server is running
+//without dropping any connection: the gap policy, the reorder window,
+//user queue limits, write timeouts and batching, session limits and the shutdown timeout
+//Queue depths, write timeouts and batching and the slow consumer policy apply to sessions
+//connecting after the reload, connected sessions keep theirs
+//Log settings aren't read by the server, the caller applies them to its logger
+//Returns the names of changed settings that only take effect after a restart,
+//those keep their running values
+//Nothing is applied if conf is invalid
+func (ms *Server) Reload(conf config.ServerConfig) ([]string, error) {
+	ms.confMutex.Lock()
+	defer ms.confMutex.Unlock()
+	applied := ms.conf
+	applied.GapPolicy = conf.GapPolicy
+	applied.GapTimeoutMs = conf.GapTimeoutMs
+	applied.GapMaxBuffered = conf.GapMaxBuffered
+	applied.MaxReorderWindow = conf.MaxReorderWindow
+	applied.UserQueueDepth = conf.UserQueueDepth
+	applied.UserWriteTimeoutMs = conf.UserWriteTimeoutMs
+	applied.UserWriteBatchSize = conf.UserWriteBatchSize
+	applied.UserFlushIntervalMs = conf.UserFlushIntervalMs
+	applied.SlowConsumerPolicy = conf.SlowConsumerPolicy
+	applied.MaxSessionsPerUser = conf.MaxSessionsPerUser
+	applied.SessionEvictionPolicy = conf.SessionEvictionPolicy
+	applied.ShutdownTimeoutMs = conf.ShutdownTimeoutMs
+
+	gap, err := newGapConfig(applied)
+	if err != nil {
+		ms.log.Error("Invalid gap policy configuration ", err)
+		return nil, err
+	}
+	sessions, err := newSessionConfig(applied)
+	if err != nil {
+		ms.log.Error("Invalid user session configuration ", err)
+		return nil, err
+	}
+	ms.inDispatcher(func(st *dispatchState) {
+		st.Gap = gap
+		st.Sessions = sessions
+		st.Shards.each(func(reg *userRegistry) {
+			reg.conf = sessions
+		})
+	})
+	ms.window.resize(applied.MaxReorderWindow)
+	ms.conf = applied
+
+	restart := restartSettings(applied, conf)
+	for _, name := range restart {
+		ms.log.Warn("Setting ", name, " changed, restart the server to apply it")
+	}
+	ms.log.Info("Reloaded configuration")
+	return restart, nil
+}
+
+//Names of the settings only read while the server starts that differ between running and next
+func restartSettings(running, next config.ServerConfig) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("eventListenerPort", running.EventListenerPort != next.EventListenerPort)
+	check("clientListenerPort", running.ClientListenerPort != next.ClientListenerPort)
+	check("adminListenerAddress", running.AdminListenerAddress != next.AdminListenerAddress)
+	check("adminListenerPort", running.AdminListenerPort != next.AdminListenerPort)
+	check("sequenceNumber", running.SequenceNumber != next.SequenceNumber)
+	check("dataDir", running.DataDir != next.DataDir)
+	check("walSegmentBytes", running.WalSegmentBytes != next.WalSegmentBytes)
+	check("walSync", running.WalSync != next.WalSync)
+	check("followerSnapshotIntervalMs", running.FollowerSnapshotIntervalMs != next.FollowerSnapshotIntervalMs)
+	check("mailboxSize", running.MailboxSize != next.MailboxSize)
+	check("mailboxMaxAgeMs", running.MailboxMaxAgeMs != next.MailboxMaxAgeMs)
+	check("historySize", running.HistorySize != next.HistorySize)
+	check("dispatchShards", running.DispatchShards != next.DispatchShards)
+	return changed
+}
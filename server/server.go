@@ -2,25 +2,52 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sahilahmadlone/MessagingSocketServer/config"
-	"github.com/sahilahmadlone/MessagingSocketServer/logger"
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
 )
 
-//Sequence counter for dispatcher
-var SequenceNum int
-
-//Server attributes for shutdown
+//Server holds all state of a single running server
+//Several independent servers can run in the same process
 type Server struct {
-	finished  chan struct{}
-	IsRunning bool
-	UListener net.Listener
-	EListener net.Listener
+	finished     chan struct{}
+	shutDownOnce sync.Once
+	IsRunning    bool
+	UListener    net.Listener
+	EListener    net.Listener
+	AListener    net.Listener
+	Stats        *Stats
+	conf         config.ServerConfig
+	confMutex    sync.Mutex
+	ctx          context.Context
+	log          Logger
+	gap          gapConfig
+	sessions     sessionConfig
+	followers    FollowerGraph
+	replica      *followerReplica
+	reorder      ReorderBuffer
+	pending      PendingEvents
+	admin        *http.Server
+	eventLog     *wal.Log
+	compacting   int32
+	window       *reorderWindow
+	sources      *eventSources
+	eventChan    chan Event
+	userChan     chan UserClient
+	control      chan func(*dispatchState)
+	stopped      chan struct{}
 }
 
 //Event struct for parsing and processing
@@ -30,66 +57,305 @@ type Event struct {
 	fromUserId int
 	toUserId   int
 	payload    string
+	//When the event was read, for measuring dispatch latency
+	received time.Time
+	//The payload as written to users, encoded once when the event is dispatched
+	line []byte
 }
 
 //User client struct for parsing and notifying
+//Clients resuming with "userId|lastSeenSequence" have resume set
 type UserClient struct {
 	userId     int
 	connection net.Conn
+	reader     *bufio.Reader
+	resume     bool
+	lastSeen   int
 }
 
-//Sets up the dispatcher with channels for when events start arriving
-//Starts Server listening on specified ports from configuration (param)
-//Starts two goroutines accepting and serving events and userClients
+//Starts a Server listening on the ports from the configuration (param)
+//Kept for existing callers, equivalent to New(WithConfig(config))
 func Run(config config.ServerConfig) (*Server, error) {
-	finished := make(chan struct{})
-
-	SequenceNum = config.SequenceNumber
+	return New(WithConfig(config))
+}
 
-	userChannel, eventChannel, err := dispatcher(finished)
+//Creates and starts a Server configured by opts
+//Sets up the dispatcher with channels for when events start arriving
+//If a data directory is configured the event log is opened and replayed
+//into the dispatcher before any connection is accepted, and the dispatcher
+//resumes from the sequence number checkpointed at the last shutdown
+//The follower graph is kept in a file-backed store under the data directory,
+//other state in memory, unless other storage is passed in, see storage.go
+//Listeners that weren't passed in are bound to the configured ports,
+//the admin API only if AdminListenerPort is set
+//Starts two goroutines accepting and serving events and userClients
+func New(opts ...Option) (*Server, error) {
+	ms := &Server{
+		conf:      config.Defaults(),
+		ctx:       context.Background(),
+		log:       packageLogger{},
+		finished:  make(chan struct{}),
+		Stats:     newStats(),
+		sources:   newEventSources(),
+		eventChan: make(chan Event),
+		userChan:  make(chan UserClient),
+		control:   make(chan func(*dispatchState)),
+		stopped:   make(chan struct{}),
+		replica:   newFollowerReplica(),
+	}
+	for _, opt := range opts {
+		opt(ms)
+	}
 
+	var err error
+	ms.gap, err = newGapConfig(ms.conf)
 	if err != nil {
+		ms.log.Error("Invalid gap policy configuration ", err)
+		ms.closeListeners()
+		ms.closeAdmin()
 		return nil, err
 	}
-	es, err := net.Listen("tcp", ":"+strconv.Itoa(config.EventListenerPort))
+	ms.sessions, err = newSessionConfig(ms.conf)
 	if err != nil {
-		recover()
+		ms.log.Error("Invalid user session configuration ", err)
+		ms.closeListeners()
+		ms.closeAdmin()
 		return nil, err
 	}
-	us, err := net.Listen("tcp", ":"+strconv.Itoa(config.ClientListenerPort))
-	if err != nil {
-		recover()
+	if err := ms.openStorage(); err != nil {
+		ms.log.Error("Unable to open storage ", err)
+		ms.closeListeners()
+		ms.closeAdmin()
 		return nil, err
 	}
-	logger.Info("Listening on Ports ", strconv.Itoa(config.EventListenerPort), " and ", strconv.Itoa(config.ClientListenerPort))
+	if ms.conf.DataDir != "" {
+		if err := ms.openEventLog(); err != nil {
+			ms.closeListeners()
+			ms.closeAdmin()
+			return nil, err
+		}
+	}
+	ms.window = newReorderWindow(ms.conf.MaxReorderWindow, ms.conf.SequenceNumber, ms.Stats, ms.log)
+	ms.dispatcher()
+
+	if ms.conf.DataDir != "" {
+		//The checkpoint decides which logged events are replayed
+		if err := ms.restoreSequence(); err != nil {
+			ms.abort()
+			return nil, err
+		}
+		if err := ms.replayEventLog(); err != nil {
+			ms.abort()
+			return nil, err
+		}
+	}
+	if ms.EListener == nil {
+		ms.EListener, err = net.Listen("tcp", ":"+strconv.Itoa(ms.conf.EventListenerPort))
+		if err != nil {
+			ms.abort()
+			return nil, err
+		}
+	}
+	if ms.UListener == nil {
+		ms.UListener, err = net.Listen("tcp", ":"+strconv.Itoa(ms.conf.ClientListenerPort))
+		if err != nil {
+			ms.abort()
+			return nil, err
+		}
+	}
+	ms.log.Info("Listening on ", ms.EListener.Addr(), " for events and ", ms.UListener.Addr(), " for users")
+	if err := ms.startAdmin(); err != nil {
+		ms.abort()
+		return nil, err
+	}
+
+	go ms.acceptAndServeUsers()
+	go ms.acceptAndServeEvents()
+	go func() {
+		select {
+		case <-ms.ctx.Done():
+			ms.ShutDown()
+		case <-ms.finished:
+		}
+	}()
+	ms.IsRunning = true
+	return ms, nil
+}
+
+//Opens the event log under the configured data directory
+func (ms *Server) openEventLog() error {
+	eventLog, err := wal.Open(filepath.Join(ms.conf.DataDir, "wal"), wal.Options{
+		SegmentBytes: ms.conf.WalSegmentBytes,
+		Sync:         ms.conf.WalSync,
+	})
+	if err != nil {
+		ms.log.Error("Unable to open event log ", err)
+		return err
+	}
+	ms.eventLog = eventLog
+	return nil
+}
 
-	go acceptAndServeUsers(userChannel, us, finished)
-	go acceptAndServeEvents(eventChannel, es, finished)
-	return &Server{finished, true, us, es}, nil
+//Replays the event log from the sequence number the dispatcher resumes at
+//Events before it were dispatched already and aren't delivered again,
+//only their follows and unfollows the graph doesn't reflect yet are applied to it, in sequence order
+//Every later event goes through the dispatcher, restoring the reorder buffer
+//Later events are held by the reorder window like live ones, those beyond it are
+//admitted in the background once the window moves so startup never waits for a gap to fill
+func (ms *Server) replayEventLog() error {
+	var next, applied int
+	ms.inDispatcher(func(st *dispatchState) {
+		next = st.SequenceNum
+		applied = appliedSequence(st.FollowerMap)
+	})
+	var changes []Event
+	err := ms.eventLog.Replay(func(record []byte) error {
+		parsedEvent, err := parseEventMessage(string(record))
+		if err != nil {
+			return err
+		}
+		if parsedEvent.sequence < next && parsedEvent.sequence > applied && isFollowerChange(*parsedEvent) {
+			changes = append(changes, *parsedEvent)
+		}
+		return nil
+	})
+	if err != nil {
+		ms.log.Error("Unable to replay event log ", err)
+		return err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].sequence < changes[j].sequence
+	})
+	ms.inDispatcher(func(st *dispatchState) {
+		for _, event := range changes {
+			ms.applyFollowerChange(event, st.FollowerMap)
+		}
+	})
+	replayed := 0
+	var held []Event
+	err = ms.eventLog.Replay(func(record []byte) error {
+		parsedEvent, err := parseEventMessage(string(record))
+		if err != nil {
+			return err
+		}
+		if parsedEvent.sequence < next {
+			return nil
+		}
+		parsedEvent.received = time.Now()
+		replayed++
+		if !ms.window.fits(parsedEvent.sequence) {
+			held = append(held, *parsedEvent)
+			return nil
+		}
+		ms.eventChan <- *parsedEvent
+		return nil
+	})
+	if err != nil {
+		ms.log.Error("Unable to replay event log ", err)
+		return err
+	}
+	if len(held) > 0 {
+		sort.Slice(held, func(i, j int) bool {
+			return held[i].sequence < held[j].sequence
+		})
+		//Tracked like a source handler so shutdown waits for it,
+		//the server isn't stopping yet since it hasn't started
+		ms.sources.handlers.Add(1)
+		go ms.admitReplayed(held)
+	}
+	ms.log.Info("Replayed ", replayed, " events and ", len(changes), " follower changes from event log, ", len(held), " waiting for the reorder window")
+	return nil
+}
+
+//Hands replayed events beyond the reorder window to the dispatcher in sequence order
+//as the window moves, events left once the window closes stay in the log for the next start
+func (ms *Server) admitReplayed(events []Event) {
+	defer ms.sources.handlers.Done()
+	for _, event := range events {
+		if !ms.window.admit(event.sequence) {
+			return
+		}
+		select {
+		case ms.eventChan <- event:
+		case <-ms.finished:
+			return
+		}
+	}
+}
+
+func (ms *Server) closeEventLog() {
+	if ms.eventLog == nil {
+		return
+	}
+	if err := ms.eventLog.Close(); err != nil {
+		ms.log.Error("Error closing event log ", err)
+	}
+}
+
+//Closes the event and user listeners, the admin API is left up
+func (ms *Server) closeListeners() {
+	if ms.EListener != nil {
+		ms.EListener.Close()
+	}
+	if ms.UListener != nil {
+		ms.UListener.Close()
+	}
+}
+
+//Stops everything New started before failing
+func (ms *Server) abort() {
+	close(ms.finished)
+	<-ms.stopped
+	ms.closeListeners()
+	ms.closeAdmin()
+	ms.closeEventLog()
 }
 
 //When listener receives event, this method handles it
 //in a goroutine -- reading in the message, parsing the message, assigning values to
-//Event struct, and sending `Event` to event channel
-func handleEventConns(connection net.Conn, eventChan chan<- Event) {
+//Event struct, appending it to the event log (if enabled) and sending `Event` to event channel
+//Reading pauses while the reorder window is full
+func (ms *Server) handleEventConns(connection net.Conn) {
+	if !ms.sources.add(connection) {
+		return
+	}
+	defer ms.sources.remove(connection)
+	defer connection.Close()
 	b := bufio.NewReader(connection)
 	for {
 		m, err := b.ReadString('\n')
 		if err != nil {
 			if err == io.EOF {
-				logger.Info("End of message stream", err)
+				ms.log.Info("End of message stream", err)
 				return
 			}
-			logger.Error(err)
+			ms.log.Error(err)
 			return
 		}
 		msg := string(m)
 		msg = strings.Trim(msg, "\n")
 		msg = strings.Trim(msg, "\r")
 		parsedEvent, err := parseEventMessage(msg)
-		if err == nil {
-			eventChan <- *parsedEvent
-
+		if err != nil {
+			ms.log.Error("Bad Request ", err, " ", msg)
+			ms.Stats.parseFailures.inc("event")
+			continue
+		}
+		parsedEvent.received = time.Now()
+		ms.Stats.eventsReceived.inc(eventTypeLabel(parsedEvent.eventType))
+		if !ms.window.admit(parsedEvent.sequence) {
+			return
+		}
+		if ms.eventLog != nil {
+			if err := ms.eventLog.Append([]byte(msg)); err != nil {
+				ms.log.Error("Unable to append event to event log ", err)
+				return
+			}
+		}
+		select {
+		case ms.eventChan <- *parsedEvent:
+		case <-ms.finished:
+			return
 		}
 	}
 
@@ -99,22 +365,34 @@ func handleEventConns(connection net.Conn, eventChan chan<- Event) {
 //reads the message from userClient, parses the clientID,
 //creates appropriate UserClient struct and sends
 //`UserClient` to the user channel
-func handleUserConns(connection net.Conn, userChan chan<- UserClient) {
+//Clients may send "userId|lastSeenSequence" instead of a bare ID
+//to be replayed everything they missed after that sequence
+//Connections sending a bad request are closed
+func (ms *Server) handleUserConns(connection net.Conn) {
 	b := bufio.NewReader(connection)
 	m, err := b.ReadString('\n')
+	if err != nil {
+		ms.log.Error("Bad User Request ", err)
+		connection.Close()
+		return
+	}
 	msg := string(m)
 	msg = strings.Trim(msg, "\n")
 	msg = strings.Trim(msg, "\r")
-	userID, err := strconv.Atoi(msg)
+	userClient, err := parseUserMessage(msg)
 	if err != nil {
-		logger.Error("Bad User Request ", err)
+		ms.log.Error("Bad User Request ", err)
+		ms.Stats.parseFailures.inc("user")
+		connection.Close()
+		return
 	}
-
-	userClient := UserClient{
-		userId:     userID,
-		connection: connection,
+	userClient.connection = connection
+	userClient.reader = b
+	select {
+	case ms.userChan <- *userClient:
+	case <-ms.finished:
+		connection.Close()
 	}
-	userChan <- userClient
 
 }
 
@@ -124,70 +402,233 @@ func handleUserConns(connection net.Conn, userChan chan<- UserClient) {
 //Using a map implementation of a Queue in order to dispatch and processes events
 // in the correct order and notifying
 //all appropriate users (if connected) determined by event type
-func dispatcher(finished chan struct{}) (chan<- UserClient, chan<- Event, error) {
-	//Queue implementation for dispatch order
-	MessageQueue := make(map[int]Event)
-	//Map to keep track of followers for a given user
-	FollowerMap := make(map[int]map[int]bool)
-	//Map to keep track of events to users
-	UserEventChannels := make(map[int]chan Event)
-	//Event channel to hold events
-	EChannel := make(chan Event)
-	//User channel to hold clients
-	UChannel := make(chan UserClient)
+//When the next sequence number is missing the configured gap policy decides
+//whether to keep waiting, skip ahead or fail the event sources
+//The reorder window is moved forward whenever the expected sequence number advances
+//Every connected user gets a userSession with its own bounded outbound queue,
+//sessions that disconnect or fail report back on the unregister channel of their shard
+//Dispatched events are handed in order to the shards of their recipients,
+//which queue them for their users in parallel, see shard.go
+//All dispatcher state is owned by the dispatcher goroutine,
+//other goroutines hand it functions to run on the control channel
+func (ms *Server) dispatcher() {
+	sessions, window, stats, finished := ms.sessions, ms.window, ms.Stats, ms.finished
+	st := &dispatchState{
+		SequenceNum:  ms.conf.SequenceNumber,
+		MessageQueue: ms.reorder,
+		FollowerMap:  ms.followers,
+		Gap:          ms.gap,
+		Sessions:     ms.sessions,
+	}
+	//Queries read a replica of the graph, see query.go
+	ms.replica.reset(st.FollowerMap)
+	var mailboxTicker *time.Ticker
+	var mailboxSweep <-chan time.Time
+	if ms.pending != nil {
+		st.Mailbox = newMailbox(ms.pending, stats, ms.log)
+		if sessions.mailboxMaxAge > 0 {
+			mailboxTicker = time.NewTicker(sessions.mailboxMaxAge)
+			mailboxSweep = mailboxTicker.C
+		}
+	}
+	//Periodic snapshots of the stores that implement Snapshotter
+	//and checkpoints of the sequence number, compacting the event log
+	var snapshotTicker *time.Ticker
+	var snapshotDue <-chan time.Time
+	if ms.conf.FollowerSnapshotIntervalMs > 0 && (len(st.snapshotters()) > 0 || ms.eventLog != nil) {
+		snapshotTicker = time.NewTicker(time.Duration(ms.conf.FollowerSnapshotIntervalMs) * time.Millisecond)
+		snapshotDue = snapshotTicker.C
+	}
+	//History of dispatched events for resuming users
+	var History *history
+	if sessions.historySize > 0 {
+		History = newHistory(sessions.historySize)
+	}
+	st.Shards = newShardSet(ms.conf.DispatchShards, sessions, st.Mailbox, History, stats, ms.log, finished)
+	//With a single shard its sessions unregister with the dispatcher itself
+	var unregister <-chan *userSession
+	if st.Shards.inline {
+		unregister = st.Shards.shards[0].unregister
+	}
+	//Timer armed while the next expected sequence number is missing
+	var gapTimer *time.Timer
+	var gapExpired <-chan time.Time
+
+	//Dispatches queued events for as long as sequence numbers are consecutive
+	//Returns true if at least one event was dispatched
+	drain := func() bool {
+		advanced := false
+		for {
+			event, ok, err := st.MessageQueue.Take(st.SequenceNum)
+			if err != nil {
+				ms.log.Error("Unable to take event ", st.SequenceNum, " from the reorder buffer ", err)
+			}
+			if ok {
+				ms.log.Debug("SequenceNumber at ", st.SequenceNum, " dispatching event ", event.payload)
+				ms.processEventMessage(event, st.FollowerMap, st.Shards)
+				st.SequenceNum++
+				advanced = true
+			} else {
+				return advanced
+			}
+		}
+	}
+	//Gives up on the missing sequence numbers in front of the lowest buffered event
+	skipGap := func() {
+		next, _ := st.MessageQueue.Lowest()
+		for ; st.SequenceNum < next; st.SequenceNum++ {
+			ms.log.Warn("Skipping missing sequence number ", st.SequenceNum)
+			atomic.AddInt64(&stats.skippedSequences, 1)
+		}
+		drain()
+	}
+	//(Re)arms the gap timer when a new gap opens and stops it once the queue is empty
+	resetGapTimer := func(advanced bool) {
+		if st.MessageQueue.Len() == 0 || !st.Gap.timed() {
+			if gapTimer != nil {
+				gapTimer.Stop()
+			}
+			gapExpired = nil
+			return
+		}
+		if advanced || gapExpired == nil {
+			if gapTimer != nil {
+				gapTimer.Stop()
+			}
+			gapTimer = time.NewTimer(st.Gap.timeout)
+			gapExpired = gapTimer.C
+		}
+	}
+
+	//Publishes the dispatcher's position, the shards publish the connected users
+	updateStats := func() {
+		atomic.StoreInt64(&stats.nextSequence, int64(st.SequenceNum))
+		atomic.StoreInt64(&stats.reorderDepth, int64(st.MessageQueue.Len()))
+	}
 
 	go func() {
+		//A persistent reorder buffer may already hold the next events
+		if drain() {
+			window.advance(st.SequenceNum)
+		}
+		resetGapTimer(true)
+		updateStats()
 		for {
 			select {
 			//For incomming events
-			case event := <-EChannel:
-				MessageQueue[event.sequence] = event
-				for {
-					if event, ok := MessageQueue[SequenceNum]; ok {
-						logger.Debug("SequenceNumber at ", SequenceNum, " dispatching event ", event.payload)
-						delete(MessageQueue, event.sequence)
-						processEventMessage(event, FollowerMap, UserEventChannels)
-						SequenceNum++
-
-					} else {
-						break
-					}
+			case event := <-ms.eventChan:
+				if event.sequence < st.SequenceNum {
+					ms.log.Warn("Dropping stale event ", event.payload, " expected sequence ", st.SequenceNum)
+					break
+				}
+				if err := st.MessageQueue.Put(event); err != nil {
+					ms.log.Error("Unable to buffer event ", event.payload, " ", err)
+					break
+				}
+				advanced := drain()
+				for st.Gap.policy == GapSkipAfterBuffered && st.MessageQueue.Len() >= st.Gap.maxBuffered {
+					skipGap()
+					advanced = true
 				}
+				if advanced {
+					window.advance(st.SequenceNum)
+				}
+				resetGapTimer(advanced)
+				updateStats()
+			//For gaps that outlived the configured timeout
+			case <-gapExpired:
+				gapExpired = nil
+				if st.Gap.policy == GapFailSource {
+					ms.log.Error("Sequence number ", st.SequenceNum, " missing for ", st.Gap.timeout, ", failed ", ms.sources.closeAll(), " event sources")
+				} else {
+					skipGap()
+					window.advance(st.SequenceNum)
+				}
+				resetGapTimer(true)
+				updateStats()
 			//For listening users
-			case conUser := <-UChannel:
-				evChan := make(chan Event, 1)
-
-				var event Event
-				go func() {
-					for {
-						select {
-						case event = <-evChan:
-							logger.Debug("Writing to user ", conUser.userId)
-							_, err := conUser.connection.Write([]byte(event.payload + "\r" + "\n"))
-							if err != nil {
-								logger.Error(err)
-							}
-						case <-finished:
-							return
-						}
-
-					}
-				}()
-				UserEventChannels[conUser.userId] = evChan
+			case conUser := <-ms.userChan:
+				owner := st.Shards.of(conUser.userId)
+				st.Shards.add(newUserSession(conUser, st.Sessions, stats, ms.log, owner.unregister, finished))
+			//For work handed to the dispatcher by other goroutines
+			case fn := <-ms.control:
+				fn(st)
+				advanced := drain()
+				if advanced {
+					window.advance(st.SequenceNum)
+				}
+				resetGapTimer(advanced)
+				updateStats()
+			//For expiring old mailbox events
+			case now := <-mailboxSweep:
+				st.Mailbox.sweep(now)
+			//For compacting the stores
+			case <-snapshotDue:
+				ms.snapshotStores(st)
+				if ms.eventLog != nil {
+					ms.checkpoint(st.SequenceNum, appliedSequence(st.FollowerMap))
+				}
+			//For disconnected users
+			case session := <-unregister:
+				st.Shards.shards[0].remove(session)
 
 			case <-finished:
+				if mailboxTicker != nil {
+					mailboxTicker.Stop()
+				}
+				if snapshotTicker != nil {
+					snapshotTicker.Stop()
+				}
+				//Shards may still be using the mailbox
+				st.Shards.wait()
+				ms.closeStores(st)
+				close(ms.stopped)
 				return
 			}
 		}
 
 	}()
-	return UChannel, EChannel, nil
 }
 
-//Takes in listener and user channel (and finished) as params
+//dispatchState is everything owned by the dispatcher goroutine
+//Other goroutines may only touch it through inDispatcher
+type dispatchState struct {
+	//Sequence counter for dispatcher
+	SequenceNum int
+	//Events buffered until their sequence number is due
+	MessageQueue ReorderBuffer
+	//Map to keep track of followers for a given user
+	FollowerMap FollowerGraph
+	//Connected users split between the shards fanning events out to them
+	Shards *shardSet
+	//Mailbox for events to users that aren't connected
+	Mailbox *mailbox
+	//Gap policy, may be replaced by Reload
+	Gap gapConfig
+	//Settings new user sessions are created with, may be replaced by Reload
+	Sessions sessionConfig
+}
+
+//Runs fn on the dispatcher goroutine and waits for it to finish
+//Returns false without running fn if the server has been shut down
+func (ms *Server) inDispatcher(fn func(st *dispatchState)) bool {
+	done := make(chan struct{})
+	select {
+	case ms.control <- func(st *dispatchState) {
+		fn(st)
+		close(done)
+	}:
+	case <-ms.finished:
+		return false
+	}
+	<-done
+	return true
+}
+
 //Accepts connection and sends it to the connection channel
 //In that event calls goroutine to handle user connections appropriately
-func acceptAndServeUsers(userChan chan<- UserClient, listener net.Listener, finished chan struct{}) {
+func (ms *Server) acceptAndServeUsers() {
+	listener, finished := ms.UListener, ms.finished
 	for {
 		connectionChannel := make(chan net.Conn)
 		go func() {
@@ -199,7 +640,7 @@ func acceptAndServeUsers(userChan chan<- UserClient, listener net.Listener, fini
 
 		select {
 		case conChan := <-connectionChannel:
-			go handleUserConns(conChan, userChan)
+			go ms.handleUserConns(conChan)
 		case <-finished:
 			listener.Close()
 			return
@@ -209,7 +650,8 @@ func acceptAndServeUsers(userChan chan<- UserClient, listener net.Listener, fini
 
 //Similar to acceptAndServeUsers, once a connection is made it's sent to connectionChannel
 //In that event the goroutine to handle and process events is started
-func acceptAndServeEvents(eventChan chan<- Event, listener net.Listener, finished chan struct{}) {
+func (ms *Server) acceptAndServeEvents() {
+	listener, finished := ms.EListener, ms.finished
 	for {
 		connectionChannel := make(chan net.Conn)
 		go func() {
@@ -222,7 +664,7 @@ func acceptAndServeEvents(eventChan chan<- Event, listener net.Listener, finishe
 
 		select {
 		case conChan := <-connectionChannel:
-			go handleEventConns(conChan, eventChan)
+			go ms.handleEventConns(conChan)
 		case <-finished:
 			listener.Close()
 			return
@@ -230,61 +672,72 @@ func acceptAndServeEvents(eventChan chan<- Event, listener net.Listener, finishe
 	}
 }
 
-//This accepts the Event itself, followers map, and a map of event conections as params
-//processEventMessage logic sends the event to the appropriate channel based on the
+//This accepts the Event itself, followers map, and the shards of user sessions as params
+//processEventMessage logic hands the event to the shards of the appropriate users based on the
 //eventType. It will also handle all the follow/unfollow logic when needed
-func processEventMessage(event Event, fm map[int]map[int]bool, eventConns map[int]chan Event) {
-	logger.Debug("Processing Event ", event.payload)
+func (ms *Server) processEventMessage(event Event, fm FollowerGraph, eventConns *shardSet) {
+	ms.log.Debug("Processing Event ", event.payload)
+	//Shared by every recipient's writer, which only read it
+	event.line = event.bytes()
 	switch event.eventType {
 	case "F":
-		follower, ok := fm[event.toUserId]
-		if !ok {
-			follower = make(map[int]bool)
-		}
-		follower[event.fromUserId] = true
-		fm[event.toUserId] = follower
-		if ec, ok := eventConns[event.toUserId]; ok {
-			ec <- event
-		}
+		ms.applyFollowerChange(event, fm)
+		eventConns.deliver(event, event.toUserId)
 	case "U":
-		follower := fm[event.toUserId]
-		delete(follower, event.fromUserId)
+		ms.applyFollowerChange(event, fm)
 	case "B":
-		for _, ec := range eventConns {
-			ec <- event
-		}
+		eventConns.broadcast(event)
 	case "P":
-		if ec, ok := eventConns[event.toUserId]; ok {
-			ec <- event
-		}
+		eventConns.deliver(event, event.toUserId)
 	case "S":
-		followers := fm[event.fromUserId]
-		for f, _ := range followers {
-			if ec, ok := eventConns[f]; ok {
-				ec <- event
-			}
-		}
+		recipients := fm.Followers(event.fromUserId)
+		eventConns.deliver(event, recipients...)
+		ms.Stats.fanout.with("S").observe(float64(len(recipients)))
 
 	}
 }
 
+//Whether the event changes the follower graph
+func isFollowerChange(event Event) bool {
+	return event.eventType == "F" || event.eventType == "U"
+}
+
+//Stores a follow or unfollow in the follower graph and records it for the replica
+//Changes the graph already reflects, see SequenceTracker, are skipped
+func (ms *Server) applyFollowerChange(event Event, fm FollowerGraph) {
+	if event.sequence <= appliedSequence(fm) {
+		return
+	}
+	if event.eventType == "F" {
+		if err := fm.Follow(event.fromUserId, event.toUserId); err != nil {
+			ms.log.Error("Unable to store follow ", event.payload, " ", err)
+		} else {
+			ms.replica.record(graphChange{follow: true, follower: event.fromUserId, followed: event.toUserId})
+		}
+		return
+	}
+	if err := fm.Unfollow(event.fromUserId, event.toUserId); err != nil {
+		ms.log.Error("Unable to store unfollow ", event.payload, " ", err)
+	} else {
+		ms.replica.record(graphChange{follower: event.fromUserId, followed: event.toUserId})
+	}
+}
+
 //Manipulates the event message received by the event listener
 //First sets sequence and payload params of the `Event`
 //then sets all other fields based on the type of the event
 //A helper function parseUserIds is used to minimize duplicative code
-//Will error, log and continue to listen with bad input.
+//Will error with bad input, the caller logs and continues to listen.
 func parseEventMessage(msg string) (*Event, error) {
 	var event Event
 	var err error
 	event.payload = msg
 	ef := strings.Split(msg, "|")
 	if len(ef) < 2 || len(ef) > 4 {
-		logger.Error("Bad Request", event.payload)
 		return nil, errors.New("Invalid Event")
 	}
 	event.sequence, err = strconv.Atoi(ef[0])
 	if err != nil {
-		logger.Error("Bad Request", event.payload)
 		return nil, err
 	}
 	event.eventType = ef[1]
@@ -293,7 +746,6 @@ func parseEventMessage(msg string) (*Event, error) {
 		event.eventType = "F"
 		parsedEvent, err := parseUserIds(ef, event)
 		if err != nil {
-			logger.Error(err)
 			return nil, err
 		}
 		event = *parsedEvent
@@ -302,7 +754,6 @@ func parseEventMessage(msg string) (*Event, error) {
 		event.eventType = "U"
 		parsedEvent, err := parseUserIds(ef, event)
 		if err != nil {
-			logger.Error(err)
 			return nil, err
 		}
 		event = *parsedEvent
@@ -315,7 +766,6 @@ func parseEventMessage(msg string) (*Event, error) {
 		event.eventType = "P"
 		parsedEvent, err := parseUserIds(ef, event)
 		if err != nil {
-			logger.Error(err)
 			return nil, err
 		}
 		event = *parsedEvent
@@ -323,9 +773,11 @@ func parseEventMessage(msg string) (*Event, error) {
 
 	case "S":
 		event.eventType = "S"
+		if len(ef) < 3 {
+			return nil, errors.New("Invalid Request")
+		}
 		fromUID, err := strconv.Atoi(ef[2])
 		if err != nil {
-			logger.Error("Bad Request ", err, " ", event.payload)
 			return nil, err
 		}
 		event.fromUserId = fromUID
@@ -335,36 +787,48 @@ func parseEventMessage(msg string) (*Event, error) {
 	return &event, nil
 }
 
+//Parses the user handshake, either a bare "userId"
+//or "userId|lastSeenSequence" for resuming clients
+func parseUserMessage(msg string) (*UserClient, error) {
+	var userClient UserClient
+	var err error
+	uf := strings.Split(msg, "|")
+	if len(uf) > 2 {
+		return nil, errors.New("Invalid User Request " + msg)
+	}
+	userClient.userId, err = strconv.Atoi(uf[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(uf) == 2 {
+		userClient.lastSeen, err = strconv.Atoi(uf[1])
+		if err != nil {
+			return nil, err
+		}
+		userClient.resume = true
+	}
+	return &userClient, nil
+}
+
 //Helper function for parseEventMessage that processes the userIds
 //of a given message
 //Will error and continue to listen if input is bad
 func parseUserIds(splitMsg []string, event Event) (*Event, error) {
 	if len(splitMsg) != 4 {
-		logger.Error("Bad Request ", event.payload)
 		err := errors.New("Invalid Request")
 		return nil, err
 	}
 	toUID, err := strconv.Atoi(splitMsg[3])
 	if err != nil {
-		logger.Error("Bad Request", err, " ", event.payload)
 		return nil, err
 	} else {
 		event.toUserId = toUID
 	}
 	fromUID, err := strconv.Atoi(splitMsg[2])
 	if err != nil {
-		logger.Error("Bad Request ", err, " ", event.payload)
 		return nil, err
 	}
 	event.fromUserId = fromUID
 	return &event, nil
 
 }
-
-func (ms *Server) ShutDown() error {
-	close(ms.finished)
-	ms.EListener.Close()
-	ms.UListener.Close()
-	ms.IsRunning = false
-	return nil
-}
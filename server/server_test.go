@@ -1,16 +1,29 @@
 package server_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sahilahmadlone/MessagingSocketServer/config"
 	"github.com/sahilahmadlone/MessagingSocketServer/logger"
 	"github.com/sahilahmadlone/MessagingSocketServer/server"
+	"github.com/sahilahmadlone/MessagingSocketServer/simulator"
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
 )
 
 func TestServer_StartAndStop(t *testing.T) {
@@ -36,13 +49,10 @@ func TestServer_Run(t *testing.T) {
 		t.Error("Error starting server")
 		return
 	}
-	os.Setenv("totalEvents", "1000")
-	out, err := exec.Command("time", "java", "-server", "-Xmx1G", "-jar", "../follower-maze-2.0.jar").Output()
-	if err != nil {
-		t.Error(err)
-	}
-	if !strings.Contains(string(out), "ALL NOTIFICATIONS RECEIVED") {
-		t.Error("Failed test run (against jar file)")
+	sim := simulator.DefaultConfig()
+	sim.TotalEvents = 1000
+	if _, err := simulator.Run(sim); err != nil {
+		t.Error("Failed test run (against simulator) ", err)
 	}
 	s.ShutDown()
 }
@@ -105,7 +115,7 @@ func TestServer_RunWithBadUsers(t *testing.T) {
 }
 
 //Benchmarking tests
-func benchmarkServer(b *testing.B, numEvents string) {
+func benchmarkServer(b *testing.B, numEvents int) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		conf := config.ServerDefaultConfig("../config/")
@@ -114,19 +124,1172 @@ func benchmarkServer(b *testing.B, numEvents string) {
 			b.Error("Error starting server")
 
 		}
-		os.Setenv("totalEvents", numEvents)
-		out, err := exec.Command("time", "java", "-server", "-Xmx1G", "-jar", "../follower-maze-2.0.jar").Output()
+		sim := simulator.DefaultConfig()
+		sim.TotalEvents = numEvents
+		if _, err := simulator.Run(sim); err != nil {
+			b.Error("Failed test run (against simulator) ", err)
+		}
+		s.ShutDown()
+	}
+
+}
+
+func Benchmark1ThousandEvents(b *testing.B)         { benchmarkServer(b, 1000) }
+func BenchmarkServer10ThousandEvents(b *testing.B)  { benchmarkServer(b, 10000) }
+func BenchmarkServer100ThousandEvents(b *testing.B) { benchmarkServer(b, 100000) }
+
+//Runs the simulator against a server with conf
+func runSimulation(tb testing.TB, conf config.ServerConfig, users int, numEvents int) {
+	es, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	us, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := server.New(server.WithConfig(conf), server.WithEventListener(es), server.WithUserListener(us), server.WithLogger(&recordingLogger{}))
+	if err != nil {
+		tb.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	sim := simulator.DefaultConfig()
+	sim.EventAddr = es.Addr().String()
+	sim.UserAddr = us.Addr().String()
+	sim.TotalEvents = numEvents
+	sim.Users = users
+	//Large runs take a while under the race detector
+	sim.Timeout = 2 * time.Minute
+	if _, err := simulator.Run(sim); err != nil {
+		tb.Error("Failed test run (against simulator) ", err)
+	}
+}
+
+//Fans out with the given number of shards, one shard is the old design,
+//everything on the dispatcher goroutine
+func shardedConfig(shards int) config.ServerConfig {
+	conf := config.Defaults()
+	conf.DispatchShards = shards
+	return conf
+}
+
+func benchmarkShards(b *testing.B, shards int) {
+	for n := 0; n < b.N; n++ {
+		runSimulation(b, shardedConfig(shards), 500, 50000)
+	}
+}
+
+//Compare with go test -bench Dispatch -cpu 1,4,8
+func BenchmarkDispatchSingleGoroutine(b *testing.B) { benchmarkShards(b, 1) }
+func BenchmarkDispatchShardPerCPU(b *testing.B)     { benchmarkShards(b, 0) }
+func BenchmarkDispatch8Shards(b *testing.B)         { benchmarkShards(b, 8) }
+
+//Status updates fan out to more events than a client reads while they are dispatched,
+//the shipped defaults must still deliver every notification without blocking dispatch
+func TestServer_SimulatorWithDefaults(t *testing.T) {
+	runSimulation(t, config.Defaults(), 100, 300000)
+}
+
+func TestServer_ShardedDispatch(t *testing.T) {
+	for _, shards := range []int{1, 4} {
+		runSimulation(t, shardedConfig(shards), 50, 2000)
+	}
+}
+
+//Writing every event on its own compared to batches of up to 64 events
+func benchmarkBatches(b *testing.B, batchSize int) {
+	conf := shardedConfig(0)
+	conf.UserWriteBatchSize = batchSize
+	for n := 0; n < b.N; n++ {
+		runSimulation(b, conf, 500, 50000)
+	}
+}
+
+func BenchmarkWriteSingleEvents(b *testing.B) { benchmarkBatches(b, 1) }
+func BenchmarkWriteBatches(b *testing.B)      { benchmarkBatches(b, 64) }
+
+func TestServer_WriteBatches(t *testing.T) {
+	conf := config.Defaults()
+	conf.UserWriteBatchSize = 8
+	conf.UserFlushIntervalMs = 5
+	runSimulation(t, conf, 50, 2000)
+
+	//Batches wait for the flush interval but no longer
+	s := newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	user, r := connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer user.Close()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(conn, "1|P|2|1\r\n2|B\r\n")
+	expectEvents(t, r, "1|P|2|1", "2|B")
+}
+
+func TestServer_RunReplaysEventLog(t *testing.T) {
+	logger.SetLevel("ERROR")
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.ServerDefaultConfig("../config/")
+	conf.DataDir = dir
+
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	conn, err := net.Dial("tcp", "localhost:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "1|F|1|2\r\n2|B\r\n4|P|2|1\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	s.ShutDown()
+
+	s, err = server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error restarting server ", err)
+	}
+	defer s.ShutDown()
+	user, err := net.Dial("tcp", "localhost:9099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	io.WriteString(user, "1\r\n")
+	time.Sleep(100 * time.Millisecond)
+	conn, err = net.Dial("tcp", "localhost:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "3|S|2\r\n")
+	conn.Close()
+
+	user.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(user)
+	for _, want := range []string{"3|S|2\r\n", "4|P|2|1\r\n"} {
+		got, err := r.ReadString('\n')
+		if err != nil || got != want {
+			t.Errorf("Expected %q after replay, got %q (%v)", want, got, err)
+		}
+	}
+}
+
+//Connects a user client, registers it with the given ID line
+//and waits for the dispatcher to pick it up
+func connectUser(t *testing.T, id string) (net.Conn, *bufio.Reader) {
+	return connectUserAt(t, "localhost:9099", id)
+}
+
+func connectUserAt(t *testing.T, addr string, id string) (net.Conn, *bufio.Reader) {
+	user, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(user, id+"\r\n")
+	time.Sleep(100 * time.Millisecond)
+	user.SetReadDeadline(time.Now().Add(3 * time.Second))
+	return user, bufio.NewReader(user)
+}
+
+func expectEvents(t *testing.T, r *bufio.Reader, events ...string) {
+	for _, want := range events {
+		got, err := r.ReadString('\n')
+		if err != nil || got != want+"\r\n" {
+			t.Errorf("Expected %q, got %q (%v)", want, got, err)
+		}
+	}
+}
+
+func runWithGapPolicy(t *testing.T, policy string) *server.Server {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	conf.GapPolicy = policy
+	conf.GapTimeoutMs = 200
+	conf.GapMaxBuffered = 2
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	return s
+}
+
+func TestServer_GapSkipAfterTimeout(t *testing.T) {
+	s := runWithGapPolicy(t, "skip-timeout")
+	defer s.ShutDown()
+	user, r := connectUser(t, "1")
+	defer user.Close()
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "2|B\r\n3|P|2|1\r\n")
+
+	expectEvents(t, r, "2|B", "3|P|2|1")
+	if s.Stats.SkippedSequences() != 1 {
+		t.Error("Expected one skipped sequence, got ", s.Stats.SkippedSequences())
+	}
+}
+
+func TestServer_GapSkipAfterBuffered(t *testing.T) {
+	s := runWithGapPolicy(t, "skip-buffer")
+	defer s.ShutDown()
+	user, r := connectUser(t, "1")
+	defer user.Close()
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "4|B\r\n3|B\r\n1|B\r\n5|B\r\n")
+
+	expectEvents(t, r, "3|B", "4|B", "5|B")
+	if s.Stats.SkippedSequences() != 2 {
+		t.Error("Expected two skipped sequences, got ", s.Stats.SkippedSequences())
+	}
+}
+
+func TestServer_GapFailSource(t *testing.T) {
+	s := runWithGapPolicy(t, "fail")
+	defer s.ShutDown()
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "2|B\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Event source should have been disconnected, got ", err)
+	}
+}
+
+func TestServer_RunWithInvalidGapPolicy(t *testing.T) {
+	conf := config.ServerDefaultConfig("../config/")
+	conf.GapPolicy = "sometimes"
+	if _, err := server.Run(*conf); err == nil {
+		t.Error("Server should refuse an unknown gap policy")
+	}
+}
+
+func TestServer_LoadRejectsBadPolicies(t *testing.T) {
+	environ := []string{"gapPolicy=sometimes", "slowConsumerPolicy=ignore", "sessionEvictionPolicy=coinflip"}
+	_, err := config.Load(nil, environ)
+	errs, ok := err.(config.Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatal("Expected 3 problems, got ", err)
+	}
+	for _, want := range []string{"INVALID GAP POLICY", "INVALID SLOW CONSUMER POLICY", "INVALID SESSION EVICTION POLICY"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be reported in %v", want, err)
+		}
+	}
+}
+
+func TestServer_LoadRejectsGapBufferBeyondReorderWindow(t *testing.T) {
+	environ := []string{"gapPolicy=skip-buffer", "gapMaxBuffered=100", "maxReorderWindow=100"}
+	if _, err := config.Load(nil, environ); err == nil || !strings.Contains(err.Error(), "maxReorderWindow") {
+		t.Error("Expected gapMaxBuffered not below maxReorderWindow to be rejected, got ", err)
+	}
+	environ = append(environ, "maxReorderWindow=101")
+	if _, err := config.Load(nil, environ); err != nil {
+		t.Error("Expected a gap buffer the reorder window can fill to be accepted, got ", err)
+	}
+	environ = append(environ, "maxReorderWindow=0")
+	if _, err := config.Load(nil, environ); err != nil {
+		t.Error("Expected any gap buffer to be accepted with an unbounded reorder window, got ", err)
+	}
+}
+
+func TestServer_LoadRejectsBlockWithoutWriteTimeout(t *testing.T) {
+	if _, err := config.Load(nil, []string{"slowConsumerPolicy=block", "userWriteTimeoutMs=0"}); err == nil {
+		t.Error("Expected block without a write timeout to be rejected")
+	}
+	if _, err := config.Load(nil, []string{"slowConsumerPolicy=block"}); err != nil {
+		t.Error("Expected block with the default write timeout to be accepted, got ", err)
+	}
+}
+
+func TestServer_ReorderWindowBackpressure(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	conf.MaxReorderWindow = 3
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	user, r := connectUser(t, "1")
+	defer user.Close()
+
+	ahead, _ := net.Dial("tcp", "localhost:9090")
+	defer ahead.Close()
+	io.WriteString(ahead, "3|B\r\n2|B\r\n4|B\r\n5|B\r\n")
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.ReorderDepth() != 2 || s.Stats.ReorderStalls() != 1 {
+		t.Error("Expected a full window and one stall, got depth ", s.Stats.ReorderDepth(), " stalls ", s.Stats.ReorderStalls())
+	}
+
+	missing, _ := net.Dial("tcp", "localhost:9090")
+	defer missing.Close()
+	io.WriteString(missing, "1|B\r\n")
+	expectEvents(t, r, "1|B", "2|B", "3|B", "4|B", "5|B")
+	if s.Stats.ReorderDepth() != 0 {
+		t.Error("Reorder buffer should be empty, got ", s.Stats.ReorderDepth())
+	}
+}
+
+//Broadcasts numEvents padded events to a stalled user 1 and a reading user 2,
+//user 2 must receive every event regardless of user 1
+func runWithStalledUser(t *testing.T, policy string, numEvents int) *server.Server {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	conf.SlowConsumerPolicy = policy
+	conf.UserQueueDepth = 10
+	conf.UserWriteTimeoutMs = 0
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	stalled, _ := connectUser(t, "1")
+	defer stalled.Close()
+	reader, r := connectUser(t, "2")
+	defer reader.Close()
+
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	padding := strings.Repeat("x", 4096)
+	reader.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 1; i <= numEvents; i++ {
+		io.WriteString(conn, strconv.Itoa(i)+"|B|"+padding+"\r\n")
+		got, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(got, strconv.Itoa(i)+"|B|") {
+			t.Errorf("User 2 stalled at event %d: %v", i, err)
+			break
+		}
+	}
+	return s
+}
+
+func TestServer_SlowConsumerDropNewest(t *testing.T) {
+	s := runWithStalledUser(t, "drop-newest", 10000)
+	defer s.ShutDown()
+	if s.Stats.DroppedEvents() == 0 {
+		t.Error("Events for the stalled user should have been dropped")
+	}
+}
+
+func TestServer_SlowConsumerDisconnect(t *testing.T) {
+	s := runWithStalledUser(t, "disconnect", 10000)
+	defer s.ShutDown()
+	if s.Stats.SlowConsumerDisconnects() != 1 {
+		t.Error("Stalled user should have been disconnected, got ", s.Stats.SlowConsumerDisconnects())
+	}
+}
+
+func TestServer_UserDisconnectUnregisters(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	user, _ := connectUser(t, "1")
+	if s.Stats.ConnectedUsers() != 1 {
+		t.Error("Expected one connected user, got ", s.Stats.ConnectedUsers())
+	}
+	user.Close()
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.ConnectedUsers() != 0 {
+		t.Error("Disconnected user should have been unregistered, got ", s.Stats.ConnectedUsers())
+	}
+}
+
+func TestServer_MultipleSessionsPerUser(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	phone, phoneReader := connectUser(t, "1")
+	defer phone.Close()
+	desktop, desktopReader := connectUser(t, "1")
+	defer desktop.Close()
+	if s.Stats.ConnectedUsers() != 1 || s.Stats.ConnectedSessions() != 2 {
+		t.Error("Expected one user with two sessions, got ", s.Stats.ConnectedUsers(), " ", s.Stats.ConnectedSessions())
+	}
+
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "1|P|2|1\r\n2|B\r\n")
+	expectEvents(t, phoneReader, "1|P|2|1", "2|B")
+	expectEvents(t, desktopReader, "1|P|2|1", "2|B")
+}
+
+func TestServer_SessionLimit(t *testing.T) {
+	logger.SetLevel("ERROR")
+	for policy, closed := range map[string]int{"evict-oldest": 0, "reject-new": 1} {
+		conf := config.ServerDefaultConfig("../config/")
+		conf.MaxSessionsPerUser = 1
+		conf.SessionEvictionPolicy = policy
+		s, err := server.Run(*conf)
 		if err != nil {
-			b.Error(err)
+			t.Fatal("Error starting server ", err)
+		}
+		first, _ := connectUser(t, "1")
+		second, _ := connectUser(t, "1")
+		sessions := []net.Conn{first, second}
+		if _, err := sessions[closed].Read(make([]byte, 1)); err != io.EOF {
+			t.Error(policy, ": session ", closed, " should have been closed, got ", err)
 		}
-		if !strings.Contains(string(out), "ALL NOTIFICATIONS RECEIVED") {
-			b.Error("Failed test run (against jar file)")
+		if s.Stats.ConnectedSessions() != 1 {
+			t.Error(policy, ": expected a single session, got ", s.Stats.ConnectedSessions())
 		}
+		first.Close()
+		second.Close()
 		s.ShutDown()
 	}
+}
+
+func TestServer_OfflineMailbox(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	conf.MailboxSize = 2
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "1|F|1|3\r\n2|P|2|1\r\n3|F|2|1\r\n4|S|3\r\n5|B\r\n")
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.MailboxDepth() != 3 || s.Stats.MailboxDropped() != 1 {
+		t.Error("Expected 3 mailbox events and 1 dropped, got ", s.Stats.MailboxDepth(), " ", s.Stats.MailboxDropped())
+	}
+
+	user, r := connectUser(t, "1")
+	defer user.Close()
+	io.WriteString(conn, "6|P|2|1\r\n")
+	expectEvents(t, r, "3|F|2|1", "4|S|3", "6|P|2|1")
+	if s.Stats.MailboxDepth() != 1 {
+		t.Error("Only user 3's mailbox should be left, got ", s.Stats.MailboxDepth())
+	}
+}
+
+func TestServer_ResumeFromSequence(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	conn, _ := net.Dial("tcp", "localhost:9090")
+	defer conn.Close()
+	io.WriteString(conn, "1|F|1|2\r\n2|P|2|1\r\n3|B\r\n4|P|2|3\r\n5|F|2|1\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	resumed, r := connectUser(t, "1|2")
+	defer resumed.Close()
+	bare, bareReader := connectUser(t, "1")
+	defer bare.Close()
+	io.WriteString(conn, "6|P|3|1\r\n")
+	expectEvents(t, r, "3|B", "5|F|2|1", "6|P|3|1")
+	expectEvents(t, bareReader, "6|P|3|1")
+}
+
+func TestServer_RunWithBadResumeRequest(t *testing.T) {
+	logger.SetLevel("ERROR")
+	conf := config.ServerDefaultConfig("../config/")
+	s, err := server.Run(*conf)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	defer s.ShutDown()
+	for _, request := range []string{"1|x", "1|2|3", "|4"} {
+		user, _ := connectUser(t, request)
+		if _, err := user.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("Bad request ", request, " should have been closed, got ", err)
+		}
+		user.Close()
+	}
+}
+
+//Logger collecting messages instead of printing them
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (rl *recordingLogger) record(m []interface{}) {
+	rl.mutex.Lock()
+	rl.messages = append(rl.messages, fmt.Sprint(m...))
+	rl.mutex.Unlock()
+}
+func (rl *recordingLogger) Debug(m ...interface{}) {}
+func (rl *recordingLogger) Info(m ...interface{})  { rl.record(m) }
+func (rl *recordingLogger) Warn(m ...interface{})  { rl.record(m) }
+func (rl *recordingLogger) Error(m ...interface{}) { rl.record(m) }
+
+//Starts a server on ephemeral ports so tests can run in parallel
+func newTestServer(t *testing.T, opts ...server.Option) *server.Server {
+	es, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	us, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(append([]server.Option{server.WithEventListener(es), server.WithUserListener(us), server.WithLogger(&recordingLogger{})}, opts...)...)
+	if err != nil {
+		t.Fatal("Error starting server ", err)
+	}
+	return s
+}
+
+func TestServer_NewRunsIndependentServers(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		t.Run("server"+strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			conf := config.Defaults()
+			conf.SequenceNumber = 100
+			s := newTestServer(t, server.WithConfig(conf))
+			defer s.ShutDown()
+			sim := simulator.DefaultConfig()
+			sim.EventAddr = s.EListener.Addr().String()
+			sim.UserAddr = s.UListener.Addr().String()
+			sim.TotalEvents = 1000
+			sim.FirstSequence = 100
+			sim.Seed = int64(i)
+			if _, err := simulator.Run(sim); err != nil {
+				t.Error(err)
+			}
+			if s.Stats.NextSequence() != 1100 {
+				t.Error("Expected next sequence 1100, got ", s.Stats.NextSequence())
+			}
+		})
+	}
+}
+
+func TestServer_NewWithContextAndLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	log := &recordingLogger{}
+	s := newTestServer(t, server.WithContext(ctx), server.WithLogger(log))
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "nonsense\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := net.Dial("tcp", s.EListener.Addr().String()); err == nil {
+		t.Error("Server should have stopped listening once the context was cancelled")
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if len(log.messages) == 0 || !strings.Contains(strings.Join(log.messages, "\n"), "Bad Request") {
+		t.Error("Expected the bad request to be logged through the injected logger ", log.messages)
+	}
+}
+
+func TestServer_DrainDeliversQueuedEvents(t *testing.T) {
+	s := newTestServer(t)
+	user, r := connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer user.Close()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|B\r\n2|B\r\n3|P|2|1\r\n5|B\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	summary, err := s.Drain(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, r, "1|B", "2|B", "3|P|2|1")
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Error("Expected the connection to be closed after draining, got ", err)
+	}
+	if summary.Sessions != 1 || summary.Drained != 1 || summary.Dropped != 0 {
+		t.Error("Expected one fully drained session, got ", summary)
+	}
+	if summary.NextSequence != 4 || summary.Undispatched != 1 {
+		t.Error("Expected next sequence 4 with one undispatched event, got ", summary)
+	}
+	if again, _ := s.Drain(time.Second); again != nil || s.IsRunning {
+		t.Error("Only the first drain should report a summary")
+	}
+}
+
+func TestServer_DrainDropsStalledSessions(t *testing.T) {
+	conf := config.Defaults()
+	conf.UserQueueDepth = 10000
+	conf.UserWriteTimeoutMs = 0
+	conf.SlowConsumerPolicy = "drop-newest"
+	s := newTestServer(t, server.WithConfig(conf))
+	stalled, _ := connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer stalled.Close()
+
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	padding := strings.Repeat("x", 4096)
+	for i := 1; i <= 5000; i++ {
+		io.WriteString(conn, strconv.Itoa(i)+"|B|"+padding+"\r\n")
+	}
+	for i := 0; i < 50 && s.Stats.NextSequence() != 5001; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	summary, _ := s.Drain(200 * time.Millisecond)
+	if time.Since(start) > 2*time.Second {
+		t.Error("Drain should give up on stalled sessions after the timeout, took ", time.Since(start))
+	}
+	if summary.Drained != 0 || summary.Dropped == 0 {
+		t.Error("Expected queued events of the stalled user to be dropped, got ", summary)
+	}
+}
+
+func TestServer_SequenceCheckpoint(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.Defaults()
+	conf.DataDir = dir
+	conf.GapPolicy = "skip-timeout"
+	conf.GapTimeoutMs = 50
+	s := newTestServer(t, server.WithConfig(conf))
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|B\r\n3|B\r\n")
+	conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if summary, err := s.Drain(time.Second); err != nil || summary.NextSequence != 4 {
+		t.Fatal("Expected sequence 2 to be skipped before shutdown, got ", summary, err)
+	}
+
+	//Without the checkpoint the replayed log would leave the server waiting for 2
+	conf.GapPolicy = "wait"
+	s = newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.NextSequence() != 4 {
+		t.Error("Expected to resume at checkpointed sequence 4, got ", s.Stats.NextSequence())
+	}
+}
+
+func TestServer_RestartDoesNotRedeliver(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.Defaults()
+	conf.DataDir = dir
+	conf.MailboxSize = 100
+	//One record per segment
+	conf.WalSegmentBytes = 16
+	s := newTestServer(t, server.WithConfig(conf))
+	user, r := connectUserAt(t, s.UListener.Addr().String(), "1")
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|P|2|1\r\n2|B\r\n3|B\r\n4|F|1|3\r\n5|B\r\n")
+	conn.Close()
+	expectEvents(t, r, "1|P|2|1", "2|B", "3|B", "5|B")
+	user.Close()
+	s.ShutDown()
+
+	//The follower graph snapshot has the follow, only the active segment is left
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal", "*.wal"))
+	if len(segments) != 1 {
+		t.Error("Expected the event log to be compacted to 1 segment, got ", segments)
+	}
+
+	s = newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	time.Sleep(100 * time.Millisecond)
+	user, r = connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer user.Close()
+	conn, _ = net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "6|S|3\r\n")
+	conn.Close()
+	expectEvents(t, r, "6|S|3")
+}
+
+func TestServer_ReplayRespectsReorderWindow(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.Defaults()
+	conf.DataDir = dir
+	s := newTestServer(t, server.WithConfig(conf))
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "2|B\r\n3|B\r\n4|B\r\n5|B\r\n6|B\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	s.ShutDown()
+
+	//The logged events no longer fit a smaller window, startup doesn't wait for the gap
+	conf.MaxReorderWindow = 3
+	s = newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.ReorderDepth() != 2 {
+		t.Error("Expected replay to fill the window with 2 events, got depth ", s.Stats.ReorderDepth())
+	}
+	user, r := connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer user.Close()
+	conn, _ = net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|B\r\n")
+	conn.Close()
+	expectEvents(t, r, "1|B", "2|B", "3|B", "4|B", "5|B", "6|B")
+}
+
+//recordingLogger that also accepts level changes from the admin API
+type levelLogger struct {
+	recordingLogger
+	level string
+}
+
+func (ll *levelLogger) SetLevel(level string) error {
+	ll.mutex.Lock()
+	ll.level = level
+	ll.mutex.Unlock()
+	return nil
+}
+
+func adminGet(t *testing.T, url string, body interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		t.Error("Invalid response from ", url, " ", err)
+	}
+}
+
+func TestServer_AdminAPI(t *testing.T) {
+	as, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &levelLogger{}
+	s := newTestServer(t, server.WithAdminListener(as), server.WithLogger(log))
+	defer s.ShutDown()
+	admin := "http://" + as.Addr().String()
+	user, _ := connectUserAt(t, s.UListener.Addr().String(), "2")
+	defer user.Close()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "1|F|1|2\r\n2|F|3|2\r\n4|B\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	var status map[string]int
+	adminGet(t, admin+"/status", &status)
+	if status["nextSequence"] != 3 || status["reorderBuffer"] != 1 || status["connectedUsers"] != 1 || status["eventSources"] != 1 {
+		t.Error("Unexpected status ", status)
+	}
+	var users []struct {
+		UserId      int
+		QueueDepths []int
+		WriteErrors *int64
+	}
+	adminGet(t, admin+"/users", &users)
+	if len(users) != 1 || users[0].UserId != 2 || len(users[0].QueueDepths) != 1 || users[0].WriteErrors == nil || *users[0].WriteErrors != 0 {
+		t.Error("Unexpected users ", users)
+	}
+	var followers map[string]int
+	adminGet(t, admin+"/followers", &followers)
+	if len(followers) != 1 || followers["2"] != 2 {
+		t.Error("Unexpected followers ", followers)
+	}
+	var sources []string
+	adminGet(t, admin+"/sources", &sources)
+	if len(sources) != 1 || sources[0] != conn.LocalAddr().String() {
+		t.Error("Unexpected sources ", sources)
+	}
+
+	resp, err := http.Post(admin+"/loglevel?level=DEBUG", "", nil)
+	log.mutex.Lock()
+	if err != nil || resp.StatusCode != http.StatusOK || log.level != "DEBUG" {
+		t.Error("Expected the log level to change, got ", log.level, " ", err)
+	}
+	log.mutex.Unlock()
+	resp, err = http.Post(admin+"/users/disconnect?id=2", "", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("Expected user 2 to be disconnected ", err)
+	}
+	user.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(user); err != nil {
+		t.Error("Expected user 2's connection to be closed ", err)
+	}
+	resp, err = http.Post(admin+"/users/disconnect?id=2", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected a disconnected user to be reported as not found")
+	}
+}
+
+func TestServer_AdminListensOnLoopback(t *testing.T) {
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	conf := config.Defaults()
+	conf.AdminListenerPort = port
+	s := newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	if addr := s.AListener.Addr().(*net.TCPAddr); !addr.IP.IsLoopback() || addr.Port != port {
+		t.Error("Expected the admin API to only listen on the loopback interface, got ", addr)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	s := newTestServer(t)
+	defer s.ShutDown()
+	user, r := connectUserAt(t, s.UListener.Addr().String(), "2")
+	defer user.Close()
+	bad, _ := net.Dial("tcp", s.UListener.Addr().String())
+	io.WriteString(bad, "nonsense\r\n")
+	bad.Close()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "1|F|1|2\r\n2|B\r\nnonsense\r\n3|S|2\r\n4|X\r\n")
+	expectEvents(t, r, "1|F|1|2", "2|B")
+	time.Sleep(100 * time.Millisecond)
+
+	if s.Stats.EventsReceived("F") != 1 || s.Stats.EventsReceived("S") != 1 {
+		t.Error("Expected one F and one S event, got ", s.Stats.EventsReceived("F"), " ", s.Stats.EventsReceived("S"))
+	}
+	if s.Stats.ParseFailures("event") != 1 || s.Stats.ParseFailures("user") != 1 {
+		t.Error("Expected one bad event and one bad user, got ", s.Stats.ParseFailures("event"), " ", s.Stats.ParseFailures("user"))
+	}
+	var out bytes.Buffer
+	if err := s.Stats.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE followermaze_events_received_total counter",
+		`followermaze_events_received_total{type="B"} 1`,
+		`followermaze_events_received_total{type="unknown"} 1`,
+		`followermaze_parse_failures_total{source="event"} 1`,
+		"followermaze_next_sequence 5",
+		"followermaze_user_write_errors_total 0",
+		"# TYPE followermaze_top_user_write_errors_total counter",
+		"followermaze_reorder_buffer_depth 0",
+		"followermaze_connected_users 1",
+		"# TYPE followermaze_dispatch_latency_seconds histogram",
+		`followermaze_dispatch_latency_seconds_bucket{le="+Inf"} 2`,
+		"followermaze_dispatch_latency_seconds_count 2",
+		`followermaze_fanout_users_bucket{type="B",le="1"} 1`,
+		`followermaze_fanout_users_count{type="S"} 1`,
+		`followermaze_fanout_users_sum{type="S"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	s := newTestServer(t)
+	defer s.ShutDown()
+	addr := s.UListener.Addr().String()
+	first, _ := connectUserAt(t, addr, "1")
+	defer first.Close()
+
+	conf := config.Defaults()
+	conf.MaxSessionsPerUser = 1
+	conf.SessionEvictionPolicy = "reject-new"
+	conf.EventListenerPort = 7777
+	conf.HistorySize = 10
+	restart, err := s.Reload(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(restart, ",") != "eventListenerPort,historySize" {
+		t.Error("Expected the port and history size to need a restart, got ", restart)
+	}
+	second, _ := connectUserAt(t, addr, "1")
+	defer second.Close()
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("The reloaded session limit should have rejected the new session, got ", err)
+	}
+	if s.Stats.ConnectedSessions() != 1 {
+		t.Error("The existing session should have survived the reload, got ", s.Stats.ConnectedSessions(), " sessions")
+	}
+
+	conf.GapPolicy = "skip-timeout"
+	conf.GapTimeoutMs = 0
+	if _, err := s.Reload(conf); err == nil {
+		t.Error("Expected an invalid gap policy to be rejected")
+	}
+
+	conf.GapPolicy = "skip-buffer"
+	conf.GapMaxBuffered = 100
+	conf.MaxReorderWindow = 100
+	if _, err := s.Reload(conf); err == nil {
+		t.Error("Expected a gap buffer the reorder window can't fill to be rejected")
+	}
+
+	conf.GapPolicy = "wait"
+	conf.SlowConsumerPolicy = "block"
+	conf.UserWriteTimeoutMs = 0
+	if _, err := s.Reload(conf); err == nil {
+		t.Error("Expected block without a write timeout to be rejected")
+	}
+}
+
+func TestServer_FollowerGraphSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.Defaults()
+	conf.DataDir = dir
+	s := newTestServer(t, server.WithConfig(conf))
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|F|2|1\r\n2|F|3|1\r\n3|U|3|1\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	s.Drain(time.Second)
+
+	as, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestServer(t, server.WithConfig(conf), server.WithAdminListener(as))
+	follower, r := connectUserAt(t, s.UListener.Addr().String(), "2")
+	defer follower.Close()
+	conn, _ = net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "4|S|1\r\n5|F|7|1\r\n")
+	expectEvents(t, r, "4|S|1")
+	time.Sleep(100 * time.Millisecond)
+
+	admin := "http://" + as.Addr().String()
+	resp, err := http.Get(admin + "/followers/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	export, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(export) != "2|1\n7|1\n" {
+		t.Errorf("Expected users 2 and 7 following user 1 to be exported, got %q", export)
+	}
+	resp, err = http.Post(admin+"/followers/import", "text/plain", strings.NewReader("5|1\n6|1\n"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the import to succeed ", err)
+	}
+	resp, _ = http.Post(admin+"/followers/import", "text/plain", strings.NewReader("5,1\n"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected an invalid graph to be rejected, got ", resp.Status)
+	}
+	snapshot, _ := ioutil.ReadFile(filepath.Join(dir, "followers", "snapshot"))
+	if string(snapshot) != "A|3\n5|1\n6|1\n" {
+		t.Errorf("Expected the imported graph to be snapshotted, got %q", snapshot)
+	}
+	conn.Close()
+	follower.Close()
+	s.Drain(time.Second)
+
+	//Replaying the logged follows must not undo the import
+	s = newTestServer(t, server.WithConfig(conf))
+	defer s.ShutDown()
+	if page := s.FollowerQuery().Followers(1, 0, 10); !reflect.DeepEqual(page.Users, []int{5, 6}) {
+		t.Error("Expected the imported followers of user 1 after a restart, got ", page.Users)
+	}
+}
+
+//Opens file-backed stores in dir for every piece of dispatcher state
+func fileStorage(t *testing.T, dir string) []server.Option {
+	graph, err := server.OpenFileFollowerGraph(filepath.Join(dir, "graph"), wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer, err := server.OpenFileReorderBuffer(filepath.Join(dir, "buffer"), wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := server.OpenFilePendingEvents(filepath.Join(dir, "pending"), 10, 0, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []server.Option{server.WithFollowerGraph(graph), server.WithReorderBuffer(buffer), server.WithPendingEvents(pending)}
+}
+
+func TestServer_FileStorage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	s := newTestServer(t, fileStorage(t, dir)...)
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	io.WriteString(conn, "1|F|2|1\r\n2|P|3|2\r\n4|S|1\r\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if summary, _ := s.Drain(time.Second); summary.Undispatched != 1 {
+		t.Fatal("Expected event 4 to wait for 3, got ", summary)
+	}
+
+	//Without an event log the stores alone bring back the follow, the buffered event and the mailbox
+	conf := config.Defaults()
+	conf.SequenceNumber = 3
+	s = newTestServer(t, append(fileStorage(t, dir), server.WithConfig(conf))...)
+	defer s.ShutDown()
+	conn, _ = net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "3|B\r\n")
+	time.Sleep(100 * time.Millisecond)
+	if s.Stats.NextSequence() != 5 {
+		t.Error("Expected the buffered event to be dispatched, next sequence is ", s.Stats.NextSequence())
+	}
+	follower, r := connectUserAt(t, s.UListener.Addr().String(), "2")
+	defer follower.Close()
+	expectEvents(t, r, "2|P|3|2", "4|S|1")
+	followed, r := connectUserAt(t, s.UListener.Addr().String(), "1")
+	defer followed.Close()
+	expectEvents(t, r, "1|F|2|1")
+}
+
+func TestServer_FailedImportKeepsGraph(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	conf := config.Defaults()
+	conf.DataDir = dir
+	as, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, server.WithConfig(conf), server.WithAdminListener(as))
+	defer s.ShutDown()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "1|F|2|1\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	//Without its directory the imported graph can't be snapshotted
+	os.RemoveAll(filepath.Join(dir, "followers"))
+	resp, err := http.Post("http://"+as.Addr().String()+"/followers/import", "text/plain", strings.NewReader("5|1\n"))
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatal("Expected the import to fail ", err)
+	}
+	if page := s.FollowerQuery().Followers(1, 0, 10); !reflect.DeepEqual(page.Users, []int{2}) {
+		t.Error("Expected queries to still see the old graph, got ", page.Users)
+	}
+}
+
+func TestServer_FileFollowerGraphKeepsGraphWhenReplaceFails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	graph, err := server.OpenFileFollowerGraph(filepath.Join(dir, "graph"), wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+	graph.Follow(2, 1)
+	//Without its directory the new snapshot can't be written
+	os.RemoveAll(filepath.Join(dir, "graph"))
+	if err := graph.Replace(map[int][]int{1: {5}}); err == nil {
+		t.Fatal("Expected the replace to fail")
+	}
+	if followers := graph.Followers(1); !reflect.DeepEqual(followers, []int{2}) {
+		t.Error("Expected the graph to be left as it was, got followers ", followers)
+	}
+}
+
+func TestServer_FilePendingEventsIgnoresPendingDuplicates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	pending, err := server.OpenFilePendingEvents(dir, 2, time.Minute, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	push := func(payload string) {
+		event, err := server.ParseEvent(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pending.Push(7, event, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payloads := func(events []server.Event) string {
+		var lines []string
+		for _, event := range events {
+			lines = append(lines, event.Payload())
+		}
+		return strings.Join(lines, ",")
+	}
+	push("1|P|2|7")
+	push("2|B")
+	push("1|P|2|7")
+	if pending.Len() != 2 {
+		t.Error("Expected the pending duplicate to be ignored, got ", pending.Len(), " events")
+	}
+	//Pushing 3 drops 1 from the full box, so 1 is no longer a duplicate
+	push("3|B")
+	push("1|P|2|7")
+	events, _, _ := pending.Take(7, now)
+	if got := payloads(events); got != "3|B,1|P|2|7" {
+		t.Error("Unexpected pending events ", got)
+	}
+	push("3|B")
+	pending.Sweep(now.Add(2 * time.Minute))
+	push("3|B")
+	pending.Close()
 
+	pending, err = server.OpenFilePendingEvents(dir, 2, time.Minute, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+	push("3|B")
+	events, _, _ = pending.Take(7, now)
+	if got := payloads(events); got != "3|B" {
+		t.Error("Expected the replayed box to hold event 3 once, got ", got)
+	}
 }
 
-func Benchmark1ThousandEvents(b *testing.B)         { benchmarkServer(b, "1000") }
-func BenchmarkServer10ThousandEvents(b *testing.B)  { benchmarkServer(b, "10000") }
-func BenchmarkServer100ThousandEvents(b *testing.B) { benchmarkServer(b, "100000") }
+func TestServer_FollowerQuery(t *testing.T) {
+	as, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, server.WithAdminListener(as))
+	defer s.ShutDown()
+	conn, _ := net.Dial("tcp", s.EListener.Addr().String())
+	defer conn.Close()
+	io.WriteString(conn, "1|F|1|2\r\n2|F|3|2\r\n3|F|2|1\r\n4|F|2|3\r\n5|U|2|3\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	q := s.FollowerQuery()
+	if page := q.Followers(2, 0, 1); !reflect.DeepEqual(page, server.UserPage{Users: []int{1}, Total: 2}) {
+		t.Error("Unexpected first page of followers ", page)
+	}
+	if page := q.Followers(2, 1, 1); !reflect.DeepEqual(page, server.UserPage{Users: []int{3}, Total: 2, Offset: 1}) {
+		t.Error("Unexpected second page of followers ", page)
+	}
+	if !q.Mutual(1, 2) || q.Mutual(2, 3) || !q.Follows(3, 2) || q.Follows(2, 3) {
+		t.Error("Unexpected follows between users 1, 2 and 3")
+	}
+
+	admin := "http://" + as.Addr().String()
+	var followees server.UserPage
+	adminGet(t, admin+"/graph/followees?id=2", &followees)
+	if !reflect.DeepEqual(followees.Users, []int{1}) || followees.Total != 1 {
+		t.Error("Unexpected followees ", followees)
+	}
+	var counts server.UserCounts
+	adminGet(t, admin+"/graph/counts?id=2", &counts)
+	if counts != (server.UserCounts{UserId: 2, Followers: 2, Followees: 1}) {
+		t.Error("Unexpected counts ", counts)
+	}
+	var mutual map[string]interface{}
+	adminGet(t, admin+"/graph/mutual?a=2&b=1", &mutual)
+	if mutual["mutual"] != true {
+		t.Error("Expected users 1 and 2 to follow each other ", mutual)
+	}
+	var users server.CountsPage
+	adminGet(t, admin+"/graph/users?offset=1&limit=5", &users)
+	expected := []server.UserCounts{{UserId: 2, Followers: 2, Followees: 1}, {UserId: 3, Followers: 0, Followees: 1}}
+	if !reflect.DeepEqual(users.Users, expected) || users.Total != 3 {
+		t.Error("Unexpected users ", users)
+	}
+	resp, err := http.Get(admin + "/graph/followers?id=x")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected an invalid user id to be rejected")
+	}
+
+	//Queries see an imported graph as a whole
+	http.Post(admin+"/followers/import", "text/plain", strings.NewReader("5|4\n"))
+	if page := q.Users(0, 10); len(page.Users) != 2 || page.Users[0].UserId != 4 || page.Users[1].UserId != 5 {
+		t.Error("Expected only the imported follow, got ", page)
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/config"
+)
+
+//SlowConsumerPolicy decides what happens to an event when a
+//user's outbound queue is already full
+type SlowConsumerPolicy int
+
+const (
+	//Disconnect the user so it can reconnect and catch up
+	Disconnect SlowConsumerPolicy = iota
+	//Discard the oldest queued event to make room for the new one
+	DropOldest
+	//Discard the new event
+	DropNewest
+	//Wait for the writer to make room, holding up dispatch to every user until it does
+	//Nothing is lost, requires a write timeout so a client that stops reading is disconnected
+	Block
+)
+
+var slowConsumerPolicies = map[string]SlowConsumerPolicy{
+	"":            Disconnect,
+	"DISCONNECT":  Disconnect,
+	"DROP-OLDEST": DropOldest,
+	"DROP-NEWEST": DropNewest,
+	"BLOCK":       Block,
+}
+
+//Parses the slow consumer policy names used in conf.json
+//Valid options are "disconnect", "drop-oldest", "drop-newest" and "block"
+func ParseSlowConsumerPolicy(policy string) (SlowConsumerPolicy, error) {
+	if p, ok := slowConsumerPolicies[strings.ToUpper(policy)]; ok {
+		return p, nil
+	}
+	return Disconnect, errors.New("INVALID SLOW CONSUMER POLICY: " + policy)
+}
+
+//SessionEvictionPolicy decides what happens when a user opens more
+//sessions than the configured per user limit
+type SessionEvictionPolicy int
+
+const (
+	//Close the user's oldest session to make room for the new one
+	EvictOldest SessionEvictionPolicy = iota
+	//Close the new session
+	RejectNew
+)
+
+var sessionEvictionPolicies = map[string]SessionEvictionPolicy{
+	"":             EvictOldest,
+	"EVICT-OLDEST": EvictOldest,
+	"REJECT-NEW":   RejectNew,
+}
+
+//Parses the session eviction policy names used in conf.json
+//Valid options are "evict-oldest" and "reject-new"
+func ParseSessionEvictionPolicy(policy string) (SessionEvictionPolicy, error) {
+	if p, ok := sessionEvictionPolicies[strings.ToUpper(policy)]; ok {
+		return p, nil
+	}
+	return EvictOldest, errors.New("INVALID SESSION EVICTION POLICY: " + policy)
+}
+
+//sessionConfig holds the settings every new user session is created with
+type sessionConfig struct {
+	queueDepth    int
+	writeTimeout  time.Duration
+	batchSize     int
+	flushInterval time.Duration
+	policy        SlowConsumerPolicy
+	maxPerUser    int
+	eviction      SessionEvictionPolicy
+	mailboxSize   int
+	mailboxMaxAge time.Duration
+	historySize   int
+}
+
+//Lets config.Load reject bad session policies before the server starts
+func init() {
+	config.AddCheck(func(conf config.ServerConfig) error {
+		policy, err := ParseSlowConsumerPolicy(conf.SlowConsumerPolicy)
+		if err != nil {
+			return err
+		}
+		return checkSlowConsumerPolicy(policy, conf)
+	})
+	config.AddCheck(func(conf config.ServerConfig) error {
+		_, err := ParseSessionEvictionPolicy(conf.SessionEvictionPolicy)
+		return err
+	})
+}
+
+func newSessionConfig(conf config.ServerConfig) (sessionConfig, error) {
+	policy, err := ParseSlowConsumerPolicy(conf.SlowConsumerPolicy)
+	if err != nil {
+		return sessionConfig{}, err
+	}
+	eviction, err := ParseSessionEvictionPolicy(conf.SessionEvictionPolicy)
+	if err != nil {
+		return sessionConfig{}, err
+	}
+	sc := sessionConfig{
+		queueDepth:    conf.UserQueueDepth,
+		writeTimeout:  time.Duration(conf.UserWriteTimeoutMs) * time.Millisecond,
+		batchSize:     conf.UserWriteBatchSize,
+		flushInterval: time.Duration(conf.UserFlushIntervalMs) * time.Millisecond,
+		policy:        policy,
+		maxPerUser:    conf.MaxSessionsPerUser,
+		eviction:      eviction,
+		mailboxSize:   conf.MailboxSize,
+		mailboxMaxAge: time.Duration(conf.MailboxMaxAgeMs) * time.Millisecond,
+		historySize:   conf.HistorySize,
+	}
+	if err := checkSlowConsumerPolicy(policy, conf); err != nil {
+		return sessionConfig{}, err
+	}
+	if sc.queueDepth < 1 {
+		sc.queueDepth = 1
+	}
+	if sc.batchSize < 1 {
+		sc.batchSize = 1
+	}
+	return sc, nil
+}
+
+//Block holds up dispatch to every user, without a write timeout
+//a client that stops reading would stall the server forever
+func checkSlowConsumerPolicy(policy SlowConsumerPolicy, conf config.ServerConfig) error {
+	if policy == Block && conf.UserWriteTimeoutMs <= 0 {
+		return errors.New("slow consumer policy " + conf.SlowConsumerPolicy + " requires a positive userWriteTimeoutMs")
+	}
+	return nil
+}
+
+//userSession is a single connected user client with its own outbound queue
+//The dispatcher enqueues and a dedicated writer goroutine drains the queue to the socket,
+//only the Block policy makes the dispatcher wait for a slow client
+//The writer combines queued events into batches written with a single writev
+//A second goroutine watches the socket so a closed client is noticed right away
+type userSession struct {
+	userId     int
+	connection net.Conn
+	reader     *bufio.Reader
+	resume     bool
+	lastSeen   int
+	queue      chan Event
+	backlog    []Event
+	batch      []Event
+	lines      [][]byte
+	done       chan struct{}
+	draining   chan struct{}
+	stopped    chan struct{}
+	drainOnce  sync.Once
+	closeOnce  sync.Once
+	conf       sessionConfig
+	stats      *Stats
+	log        Logger
+	unregister chan<- *userSession
+	finished   <-chan struct{}
+}
+
+func newUserSession(client UserClient, conf sessionConfig, stats *Stats, log Logger, unregister chan<- *userSession, finished <-chan struct{}) *userSession {
+	reader := client.reader
+	if reader == nil {
+		reader = bufio.NewReader(client.connection)
+	}
+	return &userSession{
+		userId:     client.userId,
+		connection: client.connection,
+		reader:     reader,
+		resume:     client.resume,
+		lastSeen:   client.lastSeen,
+		queue:      make(chan Event, conf.queueDepth),
+		done:       make(chan struct{}),
+		draining:   make(chan struct{}),
+		stopped:    make(chan struct{}),
+		conf:       conf,
+		stats:      stats,
+		log:        log,
+		unregister: unregister,
+		finished:   finished,
+	}
+}
+
+//Queues the event for the writer goroutine
+//When the queue is full the slow consumer policy is applied, only Block waits
+//Returns false if the session is closed and should be forgotten by the dispatcher
+func (us *userSession) enqueue(event Event) bool {
+	select {
+	case <-us.done:
+		return false
+	default:
+	}
+	select {
+	case us.queue <- event:
+		return true
+	default:
+	}
+	switch us.conf.policy {
+	case Block:
+		select {
+		case us.queue <- event:
+		case <-us.done:
+			return false
+		case <-us.finished:
+			return false
+		}
+	case DropOldest:
+		select {
+		case old := <-us.queue:
+			us.log.Warn("Queue full for user ", us.userId, " dropping oldest event ", old.payload)
+			atomic.AddInt64(&us.stats.droppedEvents, 1)
+		default:
+		}
+		select {
+		case us.queue <- event:
+		default:
+			atomic.AddInt64(&us.stats.droppedEvents, 1)
+		}
+	case DropNewest:
+		us.log.Warn("Queue full for user ", us.userId, " dropping event ", event.payload)
+		atomic.AddInt64(&us.stats.droppedEvents, 1)
+	case Disconnect:
+		us.log.Warn("Queue full for user ", us.userId, " disconnecting slow consumer")
+		atomic.AddInt64(&us.stats.slowConsumerDisconnects, 1)
+		us.close()
+		return false
+	}
+	return true
+}
+
+//Hands events that must be written before anything queued (e.g. the offline mailbox)
+//to the session, only valid before the writer goroutine is started
+func (us *userSession) preload(events []Event) {
+	us.backlog = append(us.backlog, events...)
+}
+
+//Writes the preloaded backlog followed by queued events to the user's socket
+//until the session is closed, or until the queue is empty once draining
+//A failed or timed out write disconnects the session
+func (us *userSession) writeLoop() {
+	defer close(us.stopped)
+	for len(us.backlog) > 0 {
+		n := len(us.backlog)
+		if n > us.conf.batchSize {
+			n = us.conf.batchSize
+		}
+		if err := us.write(us.backlog[:n]); err != nil {
+			us.log.Error("Error writing to user ", us.userId, " ", err)
+			us.disconnect()
+			return
+		}
+		us.backlog = us.backlog[n:]
+	}
+	us.backlog = nil
+	for {
+		select {
+		case event := <-us.queue:
+			if err := us.write(us.collect(event)); err != nil {
+				us.log.Error("Error writing to user ", us.userId, " ", err)
+				us.disconnect()
+				return
+			}
+		case <-us.draining:
+			us.flush()
+			return
+		case <-us.done:
+			return
+		case <-us.finished:
+			return
+		}
+	}
+}
+
+//Returns a batch of the event followed by queued events, up to the batch size
+//Once the queue is empty waits up to the flush interval for more
+func (us *userSession) collect(event Event) []Event {
+	us.batch = append(us.batch[:0], event)
+	var timer *time.Timer
+	var flush <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for len(us.batch) < us.conf.batchSize {
+		select {
+		case event := <-us.queue:
+			us.batch = append(us.batch, event)
+			continue
+		default:
+		}
+		if us.conf.flushInterval <= 0 {
+			break
+		}
+		if timer == nil {
+			timer = time.NewTimer(us.conf.flushInterval)
+			flush = timer.C
+		}
+		select {
+		case event := <-us.queue:
+			us.batch = append(us.batch, event)
+			continue
+		case <-flush:
+		case <-us.draining:
+		case <-us.done:
+		case <-us.finished:
+		}
+		break
+	}
+	return us.batch
+}
+
+//Writes whatever is left in the queue and closes the session
+func (us *userSession) flush() {
+	for {
+		select {
+		case event := <-us.queue:
+			if err := us.write(us.collect(event)); err != nil {
+				us.log.Error("Error writing to user ", us.userId, " ", err)
+				us.close()
+				return
+			}
+		default:
+			us.close()
+			return
+		}
+	}
+}
+
+//Asks the writer to flush the queue and close the connection,
+//stopped is closed once it is done
+func (us *userSession) drain() {
+	us.drainOnce.Do(func() {
+		close(us.draining)
+	})
+}
+
+//Writes a batch of events to the user's socket with a single writev within the write deadline
+//Successful writes record the time since each event was read
+func (us *userSession) write(events []Event) error {
+	us.log.Debug("Writing ", len(events), " events to user ", us.userId)
+	if us.conf.writeTimeout > 0 {
+		us.connection.SetWriteDeadline(time.Now().Add(us.conf.writeTimeout))
+	}
+	us.lines = us.lines[:0]
+	for _, event := range events {
+		us.lines = append(us.lines, event.bytes())
+	}
+	buffers := net.Buffers(us.lines)
+	_, err := buffers.WriteTo(us.connection)
+	if err != nil {
+		us.stats.userWriteError(us.userId)
+		return err
+	}
+	for _, event := range events {
+		if !event.received.IsZero() {
+			us.stats.dispatchLatency.observeSince(event.received)
+		}
+	}
+	return nil
+}
+
+//The event as written to users, events that weren't dispatched
+//(e.g. loaded from a store) are encoded on the spot
+func (event Event) bytes() []byte {
+	if event.line != nil {
+		return event.line
+	}
+	return []byte(event.payload + "\r" + "\n")
+}
+
+//Reads from the user's socket until it is closed or fails
+//Clients aren't expected to send anything after their ID, extra input is discarded
+func (us *userSession) watch() {
+	_, err := io.Copy(ioutil.Discard, us.reader)
+	select {
+	case <-us.done:
+		//Closed by the server, nothing to report
+	default:
+		if err == nil {
+			us.log.Info("User ", us.userId, " disconnected")
+		} else {
+			us.log.Error("User ", us.userId, " connection failed ", err)
+		}
+	}
+	us.disconnect()
+}
+
+//Closes the session and asks the dispatcher to forget about it
+func (us *userSession) disconnect() {
+	us.close()
+	select {
+	case us.unregister <- us:
+	case <-us.finished:
+	}
+}
+
+//Closes the session and its connection, safe to call more than once
+func (us *userSession) close() {
+	us.closeOnce.Do(func() {
+		close(us.done)
+		us.connection.Close()
+	})
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//Number of work items a shard's inbox holds before the dispatcher waits for it
+const shardInboxDepth = 1024
+
+//shardWork is a single item on a shard's inbox
+//Registers session if set, else runs fn if set, else delivers event
+//to recipients, or to every user of the shard if fanout is set
+type shardWork struct {
+	event      Event
+	recipients []int
+	fanout     *fanoutCount
+	session    *userSession
+	fn         func(reg *userRegistry)
+}
+
+//fanoutCount adds up the users every shard reached with a broadcast,
+//the last shard to finish records the total
+type fanoutCount struct {
+	remaining int32
+	reached   int64
+	stats     *Stats
+}
+
+func (fc *fanoutCount) done(reached int) {
+	total := atomic.AddInt64(&fc.reached, int64(reached))
+	if atomic.AddInt32(&fc.remaining, -1) == 0 {
+		fc.stats.fanout.with("B").observe(float64(total))
+	}
+}
+
+//shard owns the sessions of the users whose ID maps to it
+//It handles its inbox in order, so every user gets its events in sequence order,
+//while shards fan out to their own users in parallel
+type shard struct {
+	registry   *userRegistry
+	inbox      chan shardWork
+	unregister chan *userSession
+	stats      *Stats
+	log        Logger
+	//Users and sessions last added to Stats
+	users    int
+	sessions int
+}
+
+//Handles a single work item, on the shard's goroutine or inline on the dispatcher's
+func (sh *shard) handle(work shardWork) {
+	switch {
+	case work.session != nil:
+		if sh.registry.add(work.session) {
+			go work.session.writeLoop()
+			go work.session.watch()
+		}
+	case work.fn != nil:
+		work.fn(sh.registry)
+	case work.fanout != nil:
+		work.fanout.done(sh.registry.broadcast(work.event))
+	default:
+		sh.registry.deliver(work.event, work.recipients...)
+	}
+	sh.publish()
+}
+
+//Forgets a session that disconnected or failed
+func (sh *shard) remove(session *userSession) {
+	if sh.registry.remove(session) {
+		sh.log.Debug("Unregistered session of user ", session.userId)
+	}
+	sh.publish()
+}
+
+//Adds the change in connected users and sessions since the last call to Stats
+func (sh *shard) publish() {
+	users, sessions := sh.registry.users(), sh.registry.count()
+	if users != sh.users {
+		atomic.AddInt64(&sh.stats.connectedUsers, int64(users-sh.users))
+		sh.users = users
+	}
+	if sessions != sh.sessions {
+		atomic.AddInt64(&sh.stats.connectedSessions, int64(sessions-sh.sessions))
+		sh.sessions = sessions
+	}
+}
+
+func (sh *shard) run(finished <-chan struct{}) {
+	for {
+		select {
+		case work := <-sh.inbox:
+			sh.handle(work)
+		case session := <-sh.unregister:
+			sh.remove(session)
+		case <-finished:
+			return
+		}
+	}
+}
+
+//shardSet splits connected users between shards by user ID
+//The dispatcher routes every event, in sequence order, to the shards of its recipients
+//With a single shard everything is handled inline on the dispatcher goroutine
+//and no shard goroutine is started
+//Only ever used from the dispatcher goroutine
+type shardSet struct {
+	shards   []*shard
+	inline   bool
+	history  *history
+	stats    *Stats
+	finished <-chan struct{}
+	running  sync.WaitGroup
+}
+
+//Returns n shards sharing the mailbox and history, zero means one per CPU
+func newShardSet(n int, conf sessionConfig, mailbox *mailbox, history *history, stats *Stats, log Logger, finished <-chan struct{}) *shardSet {
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	ss := &shardSet{shards: make([]*shard, n), inline: n == 1, history: history, stats: stats, finished: finished}
+	for i := range ss.shards {
+		ss.shards[i] = &shard{
+			registry:   newUserRegistry(conf, mailbox, history, log),
+			unregister: make(chan *userSession),
+			stats:      stats,
+			log:        log,
+		}
+		if !ss.inline {
+			ss.shards[i].inbox = make(chan shardWork, shardInboxDepth)
+			ss.running.Add(1)
+			go func(sh *shard) {
+				defer ss.running.Done()
+				sh.run(finished)
+			}(ss.shards[i])
+		}
+	}
+	return ss
+}
+
+//Returns the shard owning the user
+func (ss *shardSet) of(userId int) *shard {
+	i := userId % len(ss.shards)
+	if i < 0 {
+		i += len(ss.shards)
+	}
+	return ss.shards[i]
+}
+
+//Hands work to the shard, returns false if the server stopped first
+func (ss *shardSet) send(sh *shard, work shardWork) bool {
+	if ss.inline {
+		sh.handle(work)
+		return true
+	}
+	select {
+	case sh.inbox <- work:
+		return true
+	case <-ss.finished:
+		return false
+	}
+}
+
+//Queues the event for every listed user and records it in the history
+func (ss *shardSet) deliver(event Event, recipients ...int) {
+	if ss.history != nil {
+		ss.history.record(event, recipients, false)
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	if ss.inline || len(recipients) == 1 {
+		ss.send(ss.of(recipients[0]), shardWork{event: event, recipients: recipients})
+		return
+	}
+	split := make(map[*shard][]int)
+	for _, userId := range recipients {
+		sh := ss.of(userId)
+		split[sh] = append(split[sh], userId)
+	}
+	for sh, users := range split {
+		ss.send(sh, shardWork{event: event, recipients: users})
+	}
+}
+
+//Queues the event for every connected user and records it in the history
+func (ss *shardSet) broadcast(event Event) {
+	if ss.history != nil {
+		ss.history.record(event, nil, true)
+	}
+	fanout := &fanoutCount{remaining: int32(len(ss.shards)), stats: ss.stats}
+	for _, sh := range ss.shards {
+		if !ss.send(sh, shardWork{event: event, fanout: fanout}) {
+			return
+		}
+	}
+}
+
+//Registers a new session with the shard of its user
+func (ss *shardSet) add(session *userSession) {
+	ss.send(ss.of(session.userId), shardWork{session: session})
+}
+
+//Runs fn with the registry of the shard on its goroutine, after everything
+//handed to the shard before, and waits for it
+//Returns false without running fn if the server stopped first
+func (ss *shardSet) call(sh *shard, fn func(reg *userRegistry)) bool {
+	if ss.inline {
+		sh.handle(shardWork{fn: fn})
+		return true
+	}
+	done := make(chan struct{})
+	if !ss.send(sh, shardWork{fn: func(reg *userRegistry) {
+		fn(reg)
+		close(done)
+	}}) {
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-ss.finished:
+		//fn may be running, it is done once the shards have stopped
+		ss.wait()
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+//Runs fn with the registry of every shard, one shard after the other
+func (ss *shardSet) each(fn func(reg *userRegistry)) {
+	for _, sh := range ss.shards {
+		if !ss.call(sh, fn) {
+			return
+		}
+	}
+}
+
+//Waits for the shard goroutines to stop once the server has finished
+func (ss *shardSet) wait() {
+	ss.running.Wait()
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
+)
+
+//ShutdownSummary reports what a graceful shutdown managed to deliver
+type ShutdownSummary struct {
+	//Next sequence number the server expected when it stopped
+	NextSequence int
+	//Sessions that were connected when the drain started
+	Sessions int
+	//Sessions that wrote out their whole queue before the deadline
+	Drained int
+	//Events still queued for sessions that missed the deadline
+	Dropped int
+	//Events buffered behind a missing sequence number, never dispatched
+	Undispatched int
+}
+
+func (sum ShutdownSummary) String() string {
+	return fmt.Sprintf("next sequence %d, drained %d of %d sessions, dropped %d queued events, %d undispatched events",
+		sum.NextSequence, sum.Drained, sum.Sessions, sum.Dropped, sum.Undispatched)
+}
+
+//Stops the server, safe to call more than once
+//Waits up to the configured shutdown timeout for queued events to reach users
+func (ms *Server) ShutDown() error {
+	ms.confMutex.Lock()
+	timeout := time.Duration(ms.conf.ShutdownTimeoutMs) * time.Millisecond
+	ms.confMutex.Unlock()
+	_, err := ms.Drain(timeout)
+	return err
+}
+
+//Gracefully stops the server
+//Stops accepting connections and events, lets every session write out
+//what is already queued for up to timeout, then closes whatever is left
+//The next expected sequence number is checkpointed to the data directory
+//Only the first call drains, later calls return a nil summary
+func (ms *Server) Drain(timeout time.Duration) (*ShutdownSummary, error) {
+	var summary *ShutdownSummary
+	var err error
+	ms.shutDownOnce.Do(func() {
+		summary, err = ms.drain(timeout)
+		ms.IsRunning = false
+	})
+	return summary, err
+}
+
+func (ms *Server) drain(timeout time.Duration) (*ShutdownSummary, error) {
+	summary := &ShutdownSummary{}
+	ms.closeListeners()
+	ms.window.close()
+	//A handler may be between logging an event and handing it to the dispatcher
+	ms.sources.stop()
+
+	var sessions []*userSession
+	ms.inDispatcher(func(st *dispatchState) {
+		st.Shards.each(func(reg *userRegistry) {
+			for _, session := range reg.all() {
+				session.drain()
+				sessions = append(sessions, session)
+			}
+		})
+	})
+	summary.Sessions = len(sessions)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	for _, session := range sessions {
+		if !expired {
+			select {
+			case <-session.stopped:
+				summary.Drained++
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		//Past the deadline sessions are only checked, not waited for
+		select {
+		case <-session.stopped:
+			summary.Drained++
+		default:
+			summary.Dropped += len(session.queue)
+			session.close()
+		}
+	}
+
+	ms.inDispatcher(func(st *dispatchState) {
+		summary.NextSequence = st.SequenceNum
+		summary.Undispatched = st.MessageQueue.Len()
+	})
+	close(ms.finished)
+	//The dispatcher snapshots and closes its stores on the way out
+	<-ms.stopped
+	ms.closeAdmin()
+
+	var err error
+	if ms.conf.DataDir != "" {
+		err = writeSequence(ms.conf.DataDir, summary.NextSequence)
+		if err != nil {
+			ms.log.Error("Unable to checkpoint sequence number ", err)
+		} else {
+			ms.compactEventLog(summary.NextSequence, appliedSequence(ms.followers))
+		}
+	}
+	ms.closeEventLog()
+	ms.log.Info("Server shut down, ", summary)
+	return summary, err
+}
+
+//Moves the dispatcher forward to the sequence number checkpointed at the
+//last shutdown, so sequence numbers skipped before it aren't waited for again
+func (ms *Server) restoreSequence() error {
+	next, err := readSequence(ms.conf.DataDir)
+	if err != nil {
+		ms.log.Error("Unable to read sequence checkpoint ", err)
+		return err
+	}
+	ms.inDispatcher(func(st *dispatchState) {
+		if next <= st.SequenceNum {
+			return
+		}
+		ms.log.Info("Resuming at checkpointed sequence number ", next)
+		for seq, ok := st.MessageQueue.Lowest(); ok && seq < next; seq, ok = st.MessageQueue.Lowest() {
+			if _, _, err := st.MessageQueue.Take(seq); err != nil {
+				ms.log.Error("Unable to discard buffered event ", seq, " ", err)
+				break
+			}
+		}
+		st.SequenceNum = next
+		ms.window.advance(next)
+	})
+	return nil
+}
+
+//Checkpoints the sequence number the dispatcher expects next while running,
+//so a restart after a crash doesn't deliver the events before it again,
+//and compacts the event log in the background
+//Only called from the dispatcher goroutine, right after the stores were snapshotted
+func (ms *Server) checkpoint(next int, applied int) {
+	if err := writeSequence(ms.conf.DataDir, next); err != nil {
+		ms.log.Error("Unable to checkpoint sequence number ", err)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ms.compacting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&ms.compacting, 0)
+		ms.compactEventLog(next, applied)
+	}()
+}
+
+//Deletes the event log segments holding only events before the checkpointed sequence number next
+//Follows and unfollows after the sequence number the follower graph applied are kept,
+//replaying them is how the follower graph is rebuilt
+func (ms *Server) compactEventLog(next int, applied int) {
+	removed, err := ms.eventLog.Compact(func(record []byte) bool {
+		parsedEvent, err := parseEventMessage(string(record))
+		if err != nil || parsedEvent.sequence >= next {
+			return false
+		}
+		return !isFollowerChange(*parsedEvent) || parsedEvent.sequence <= applied
+	})
+	if err != nil && err != wal.ErrClosed {
+		ms.log.Error("Unable to compact event log ", err)
+	}
+	if removed > 0 {
+		ms.log.Info("Compacted event log, removed ", removed, " segments before sequence number ", next)
+	}
+}
+
+func sequencePath(dir string) string {
+	return filepath.Join(dir, "sequence")
+}
+
+//Writes the checkpoint to a temporary file first so a crash never leaves
+//a half written one behind
+func writeSequence(dir string, next int) error {
+	tmp := sequencePath(dir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(next)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sequencePath(dir))
+}
+
+//Returns zero when no checkpoint has been written yet
+func readSequence(dir string) (int, error) {
+	data, err := ioutil.ReadFile(sequencePath(dir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,110 @@
+package server
+
+import "sync/atomic"
+
+//Stats holds counters updated by the server while it is running
+//All counters are safe to read from any goroutine
+//WritePrometheus exports them together with latency and fan-out histograms
+type Stats struct {
+	skippedSequences        int64
+	reorderDepth            int64
+	reorderStalls           int64
+	droppedEvents           int64
+	slowConsumerDisconnects int64
+	connectedUsers          int64
+	connectedSessions       int64
+	mailboxDepth            int64
+	mailboxDropped          int64
+	nextSequence            int64
+	userWriteErrors         int64
+	writeErrorsByUser       *userCounter
+	eventsReceived          counterVec
+	parseFailures           counterVec
+	dispatchLatency         *histogram
+	fanout                  *histogramVec
+}
+
+func newStats() *Stats {
+	return &Stats{
+		writeErrorsByUser: newUserCounter(trackedWriteErrorUsers),
+		dispatchLatency:   newHistogram(dispatchLatencyBuckets),
+		fanout:            newHistogramVec(fanoutBuckets),
+	}
+}
+
+//Number of sequence numbers the gap policy gave up waiting for
+func (st *Stats) SkippedSequences() int64 {
+	return atomic.LoadInt64(&st.skippedSequences)
+}
+
+//Number of events currently held in the reorder buffer
+func (st *Stats) ReorderDepth() int64 {
+	return atomic.LoadInt64(&st.reorderDepth)
+}
+
+//Number of times an event source was paused because the reorder buffer was full
+func (st *Stats) ReorderStalls() int64 {
+	return atomic.LoadInt64(&st.reorderStalls)
+}
+
+//Number of events discarded because a user's outbound queue was full
+func (st *Stats) DroppedEvents() int64 {
+	return atomic.LoadInt64(&st.droppedEvents)
+}
+
+//Number of users disconnected because their outbound queue was full
+func (st *Stats) SlowConsumerDisconnects() int64 {
+	return atomic.LoadInt64(&st.slowConsumerDisconnects)
+}
+
+//Number of users currently registered with the dispatcher
+func (st *Stats) ConnectedUsers() int64 {
+	return atomic.LoadInt64(&st.connectedUsers)
+}
+
+//Number of live user sessions, a user may be connected more than once
+func (st *Stats) ConnectedSessions() int64 {
+	return atomic.LoadInt64(&st.connectedSessions)
+}
+
+//Number of undelivered events held in offline mailboxes
+func (st *Stats) MailboxDepth() int64 {
+	return atomic.LoadInt64(&st.mailboxDepth)
+}
+
+//Number of mailbox events discarded because a box was full or the event expired
+func (st *Stats) MailboxDropped() int64 {
+	return atomic.LoadInt64(&st.mailboxDropped)
+}
+
+//Next sequence number the dispatcher expects
+func (st *Stats) NextSequence() int64 {
+	return atomic.LoadInt64(&st.nextSequence)
+}
+
+//Number of failed writes to user clients
+func (st *Stats) UserWriteErrors() int64 {
+	return atomic.LoadInt64(&st.userWriteErrors)
+}
+
+//Number of failed writes to the given user's clients
+//Only the users with the most failures are tracked, the others read as zero
+func (st *Stats) UserWriteErrorsFor(userId int) int64 {
+	return st.writeErrorsByUser.get(userId)
+}
+
+func (st *Stats) userWriteError(userId int) {
+	atomic.AddInt64(&st.userWriteErrors, 1)
+	st.writeErrorsByUser.inc(userId)
+}
+
+//Number of events of the given type read from event sources,
+//types other than F, U, B, P and S are counted as "unknown"
+func (st *Stats) EventsReceived(eventType string) int64 {
+	return st.eventsReceived.get(eventType)
+}
+
+//Number of messages from "event" or "user" connections that couldn't be parsed
+func (st *Stats) ParseFailures(source string) int64 {
+	return st.parseFailures.get(source)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
+)
+
+//Storage interfaces for the state the dispatcher keeps between events
+//By default everything is kept in memory, with a data directory configured
+//the follower graph is kept in a file-backed store under <dataDir>/followers
+//Embedding applications can plug in their own backends with WithFollowerGraph,
+//WithReorderBuffer and WithPendingEvents
+//Implementations are never called concurrently, so they don't need to be safe for concurrent use
+//The follower graph and reorder buffer are only called from the dispatcher goroutine,
+//pending events from the shards too, one at a time
+
+//FollowerGraph stores who follows whom
+type FollowerGraph interface {
+	//Records that follower follows followed
+	Follow(follower int, followed int) error
+	//Removes the follow of followed by follower, if there is one
+	Unfollow(follower int, followed int) error
+	//Returns the followers of user in any order
+	Followers(user int) []int
+	//Calls fn with every followed user and its followers
+	Each(fn func(followed int, followers []int))
+	//Replaces the whole graph, follows maps followed users to their followers
+	Replace(follows map[int][]int) error
+	//Releases the store, called once when the server stops
+	Close() error
+}
+
+//ReorderBuffer holds events that arrived ahead of the next expected sequence number
+type ReorderBuffer interface {
+	//Buffers the event, replacing a buffered event with the same sequence number
+	Put(event Event) error
+	//Removes and returns the event with the sequence number, ok is false if it isn't buffered
+	Take(sequence int) (event Event, ok bool, err error)
+	//Returns the lowest buffered sequence number, ok is false if the buffer is empty
+	Lowest() (sequence int, ok bool)
+	//Number of buffered events
+	Len() int
+	//Releases the store, called once when the server stops
+	Close() error
+}
+
+//PendingEvents holds events addressed to users that aren't connected,
+//the offline mailbox, and decides how many events a user may have pending and for how long
+type PendingEvents interface {
+	//Stores the event for the user at now
+	//Returns the number of the user's events discarded because the box was full or they expired
+	Push(user int, event Event, now time.Time) (dropped int, err error)
+	//Removes and returns the user's unexpired events in the order they were pushed
+	//and the number of expired events discarded
+	Take(user int, now time.Time) (events []Event, dropped int, err error)
+	//Discards the expired events of every user and returns how many
+	Sweep(now time.Time) (dropped int, err error)
+	//Number of stored events
+	Len() int
+	//Releases the store, called once when the server stops
+	Close() error
+}
+
+//Snapshotter is implemented by stores that compact their state from time to time
+//The dispatcher calls Snapshot every FollowerSnapshotIntervalMs and before Close
+type Snapshotter interface {
+	Snapshot() error
+}
+
+//SequenceTracker is implemented by follower graphs that persist on their own
+//Before every snapshot and replace the dispatcher marks the graph with the sequence number
+//of the last event applied to it, follows and unfollows up to it aren't applied again
+//when the event log is replayed, so they can't undo an imported graph
+type SequenceTracker interface {
+	//Records that the graph reflects every event up to and including sequence
+	MarkApplied(sequence int) error
+	//Returns the last sequence number marked, -1 if none
+	Applied() int
+}
+
+//Returns the last sequence number applied to the graph, -1 if it doesn't track it
+func appliedSequence(graph FollowerGraph) int {
+	if tracker, ok := graph.(SequenceTracker); ok {
+		return tracker.Applied()
+	}
+	return -1
+}
+
+//Sequence number of the event
+func (event Event) Sequence() int {
+	return event.sequence
+}
+
+//The event as it was read from the event source, e.g. "43|F|1|2"
+func (event Event) Payload() string {
+	return event.payload
+}
+
+//Parses an event from its payload, for stores that keep events outside of memory
+func ParseEvent(payload string) (Event, error) {
+	event, err := parseEventMessage(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	event.received = time.Now()
+	return *event, nil
+}
+
+//Fills in the stores that weren't passed in as options
+//With a data directory configured the follower graph is kept under <dataDir>/followers,
+//otherwise in memory, the reorder buffer is kept in memory and the offline mailbox
+//too if MailboxSize is set
+func (ms *Server) openStorage() error {
+	if ms.followers == nil && ms.conf.DataDir != "" {
+		graph, err := OpenFileFollowerGraph(filepath.Join(ms.conf.DataDir, "followers"), wal.Options{
+			SegmentBytes: ms.conf.WalSegmentBytes,
+			Sync:         ms.conf.WalSync,
+		})
+		if err != nil {
+			return err
+		}
+		ms.followers = graph
+	} else if ms.followers == nil {
+		ms.followers = NewMemoryFollowerGraph()
+	}
+	if ms.reorder == nil {
+		ms.reorder = NewMemoryReorderBuffer()
+	}
+	if ms.pending == nil && ms.sessions.mailboxSize > 0 {
+		ms.pending = NewMemoryPendingEvents(ms.sessions.mailboxSize, ms.sessions.mailboxMaxAge)
+	}
+	return nil
+}
+
+//Returns the stores of the dispatcher that implement Snapshotter
+func (st *dispatchState) snapshotters() []Snapshotter {
+	var snapshotters []Snapshotter
+	for _, store := range st.stores() {
+		if s, ok := store.(Snapshotter); ok {
+			snapshotters = append(snapshotters, s)
+		}
+	}
+	return snapshotters
+}
+
+func (st *dispatchState) stores() []io.Closer {
+	stores := []io.Closer{st.FollowerMap, st.MessageQueue}
+	if st.Mailbox != nil {
+		stores = append(stores, st.Mailbox.store)
+	}
+	return stores
+}
+
+func (ms *Server) snapshotStores(st *dispatchState) {
+	if tracker, ok := st.FollowerMap.(SequenceTracker); ok {
+		if err := tracker.MarkApplied(st.SequenceNum - 1); err != nil {
+			ms.log.Error("Unable to mark the follower graph ", err)
+		}
+	}
+	if st.Mailbox != nil {
+		st.Mailbox.mutex.Lock()
+		defer st.Mailbox.mutex.Unlock()
+	}
+	for _, s := range st.snapshotters() {
+		if err := s.Snapshot(); err != nil {
+			ms.log.Error("Unable to snapshot storage ", err)
+		}
+	}
+}
+
+//Snapshots and closes every store, called when the dispatcher stops
+func (ms *Server) closeStores(st *dispatchState) {
+	ms.snapshotStores(st)
+	for _, store := range st.stores() {
+		if err := store.Close(); err != nil {
+			ms.log.Error("Unable to close storage ", err)
+		}
+	}
+}
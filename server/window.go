@@ -0,0 +1,77 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//reorderWindow bounds how far ahead of the next expected sequence number
+//events may be buffered by the dispatcher
+//Event handlers ask the window to admit an event before handing it to the dispatcher
+//and block while it is too far ahead, which stops them reading from their socket
+//and pushes back on the event source through TCP flow control
+//Events up to and including the missing one are always admitted,
+//so the buffer never holds more than max events and the gap can still be closed
+type reorderWindow struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	max    int
+	next   int
+	closed bool
+	stats  *Stats
+	log    Logger
+}
+
+//A max of zero or less means the window is unbounded
+func newReorderWindow(max int, next int, stats *Stats, log Logger) *reorderWindow {
+	rw := &reorderWindow{max: max, next: next, stats: stats, log: log}
+	rw.cond = sync.NewCond(&rw.mutex)
+	return rw
+}
+
+//Waits until the event with sequence seq fits into the window
+//Returns false if the window was closed while waiting
+func (rw *reorderWindow) admit(seq int) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	if rw.max > 0 && seq >= rw.next+rw.max && !rw.closed {
+		atomic.AddInt64(&rw.stats.reorderStalls, 1)
+		rw.log.Warn("Reorder buffer full, pausing event source at sequence ", seq, " waiting for ", rw.next)
+		for seq >= rw.next+rw.max && !rw.closed {
+			rw.cond.Wait()
+		}
+	}
+	return !rw.closed
+}
+
+//Reports whether the event with sequence seq fits into the window without waiting
+func (rw *reorderWindow) fits(seq int) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	return rw.max <= 0 || seq < rw.next+rw.max
+}
+
+//Moves the window forward once the dispatcher expects sequence next
+func (rw *reorderWindow) advance(next int) {
+	rw.mutex.Lock()
+	rw.next = next
+	rw.mutex.Unlock()
+	rw.cond.Broadcast()
+}
+
+//Changes the size of the window, handlers waiting on a window that grew are released
+//A max of zero or less means the window is unbounded
+func (rw *reorderWindow) resize(max int) {
+	rw.mutex.Lock()
+	rw.max = max
+	rw.mutex.Unlock()
+	rw.cond.Broadcast()
+}
+
+//Unblocks every waiting event handler, used on shutdown
+func (rw *reorderWindow) close() {
+	rw.mutex.Lock()
+	rw.closed = true
+	rw.mutex.Unlock()
+	rw.cond.Broadcast()
+}
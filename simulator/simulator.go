@@ -0,0 +1,496 @@
+package simulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Pure Go replacement for the follower-maze jar
+//Generates a reproducible (seeded) stream of events, connects user clients,
+//sends the events to the server and checks that every client received
+//exactly the notifications it should have, in order
+//Events are generated while they are sent and clients only keep a count and a hash
+//of what they received, so memory doesn't grow with the number of events
+
+//Config describes a single simulation run
+type Config struct {
+	EventAddr     string
+	UserAddr      string
+	TotalEvents   int
+	Users         int
+	Seed          int64
+	MaxBatch      int
+	FirstSequence int
+	//Time given to the server to register every user before events are sent
+	SettleTime time.Duration
+	//Time the run waits for the next notification once every event is sent,
+	//it gives up when no client received anything for that long
+	Timeout time.Duration
+}
+
+//Result summarizes a simulation run
+type Result struct {
+	Events        int
+	Notifications int
+	Elapsed       time.Duration
+}
+
+//Returns the configuration the follower-maze jar uses by default
+func DefaultConfig() Config {
+	return Config{
+		EventAddr:     "localhost:9090",
+		UserAddr:      "localhost:9099",
+		TotalEvents:   10000000,
+		Users:         100,
+		Seed:          666,
+		MaxBatch:      100,
+		FirstSequence: 1,
+		SettleTime:    200 * time.Millisecond,
+		Timeout:       20 * time.Second,
+	}
+}
+
+//Event types and how often they are generated (in percent)
+var eventMix = []struct {
+	eventType string
+	weight    int
+}{
+	{"F", 25},
+	{"U", 10},
+	{"B", 5},
+	{"P", 20},
+	{"S", 40},
+}
+
+//generator produces the event lines of a run one at a time in sequence order
+type generator struct {
+	r     *rand.Rand
+	users int
+	next  int
+	end   int
+}
+
+func newGenerator(conf Config) *generator {
+	return &generator{
+		r:     rand.New(rand.NewSource(conf.Seed)),
+		users: conf.Users,
+		next:  conf.FirstSequence,
+		end:   conf.FirstSequence + conf.TotalEvents,
+	}
+}
+
+//Returns the next event line, false once TotalEvents were generated
+func (g *generator) event() (string, bool) {
+	if g.next >= g.end {
+		return "", false
+	}
+	seq := strconv.Itoa(g.next)
+	g.next++
+	from, to := randomPair(g.r, g.users)
+	switch pickType(g.r) {
+	case "F":
+		return seq + "|F|" + from + "|" + to, true
+	case "U":
+		return seq + "|U|" + from + "|" + to, true
+	case "B":
+		return seq + "|B", true
+	case "P":
+		return seq + "|P|" + from + "|" + to, true
+	default:
+		return seq + "|S|" + from, true
+	}
+}
+
+//Generates TotalEvents event lines in sequence order
+//The same config always produces the same events
+//Every event is held in memory, Run generates them as they are sent instead
+func Generate(conf Config) []string {
+	g := newGenerator(conf)
+	events := make([]string, 0, conf.TotalEvents)
+	for e, ok := g.event(); ok; e, ok = g.event() {
+		events = append(events, e)
+	}
+	return events
+}
+
+//Shuffles events within consecutive batches of at most maxBatch events,
+//mimicking an event source that sends out of order
+func Shuffle(events []string, maxBatch int, seed int64) []string {
+	shuffled := append([]string{}, events...)
+	if maxBatch < 2 {
+		return shuffled
+	}
+	r := rand.New(rand.NewSource(seed))
+	for start := 0; start < len(shuffled); {
+		end := start + 1 + r.Intn(maxBatch)
+		if end > len(shuffled) {
+			end = len(shuffled)
+		}
+		shuffleBatch(r, shuffled[start:end])
+		start = end
+	}
+	return shuffled
+}
+
+func shuffleBatch(r *rand.Rand, batch []string) {
+	for i := len(batch) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		batch[i], batch[j] = batch[j], batch[i]
+	}
+}
+
+//router keeps track of the follower graph to work out who is notified of an event
+type router struct {
+	users     int
+	followers map[int]map[int]bool
+}
+
+func newRouter(users int) *router {
+	return &router{users: users, followers: make(map[int]map[int]bool)}
+}
+
+//Calls notify for every user 1..users the event is delivered to
+//Events must be routed in sequence order
+func (rt *router) route(e string, notify func(userId int)) {
+	fields := strings.Split(e, "|")
+	switch fields[1] {
+	case "F":
+		from, to := atoi(fields[2]), atoi(fields[3])
+		if rt.followers[to] == nil {
+			rt.followers[to] = make(map[int]bool)
+		}
+		rt.followers[to][from] = true
+		notify(to)
+	case "U":
+		delete(rt.followers[atoi(fields[3])], atoi(fields[2]))
+	case "B":
+		for u := 1; u <= rt.users; u++ {
+			notify(u)
+		}
+	case "P":
+		notify(atoi(fields[3]))
+	case "S":
+		for f := range rt.followers[atoi(fields[2])] {
+			notify(f)
+		}
+	}
+}
+
+//Works out which notifications every user 1..users should receive, in order
+//Events are expected in sequence order
+func Expected(events []string, users int) map[int][]string {
+	expected := make(map[int][]string)
+	rt := newRouter(users)
+	for _, e := range events {
+		rt.route(e, func(userId int) {
+			expected[userId] = append(expected[userId], e)
+		})
+	}
+	return expected
+}
+
+//stream is the count and hash of the notifications a user receives, in order
+type stream struct {
+	count int
+	hash  hash.Hash64
+	last  string
+}
+
+func newStream() *stream {
+	return &stream{hash: fnv.New64a()}
+}
+
+func (st *stream) add(line string) {
+	st.count++
+	st.hash.Write([]byte(line))
+	st.hash.Write([]byte{'\n'})
+	st.last = line
+}
+
+//Runs a full simulation against the server
+//Returns an error describing the first mismatches if any client
+//didn't receive exactly the notifications it should have
+func Run(conf Config) (*Result, error) {
+	start := time.Now()
+	expected := make([]*stream, conf.Users+1)
+	for i := range expected {
+		expected[i] = newStream()
+	}
+	rt := newRouter(conf.Users)
+	g := newGenerator(conf)
+	for e, ok := g.event(); ok; e, ok = g.event() {
+		rt.route(e, func(userId int) {
+			expected[userId].add(e)
+		})
+	}
+	total := 0
+	for _, e := range expected {
+		total += e.count
+	}
+
+	clients := make([]*client, conf.Users)
+	var wg sync.WaitGroup
+	var received int64
+	for i := range clients {
+		c, err := connectClient(conf.UserAddr, i+1, expected[i+1].count, &wg, &received)
+		if err != nil {
+			closeClients(clients)
+			return nil, err
+		}
+		clients[i] = c
+	}
+	time.Sleep(conf.SettleTime)
+
+	if err := sendEvents(conf.EventAddr, newGenerator(conf), conf.MaxBatch, conf.Seed); err != nil {
+		closeClients(clients)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	waitForClients(done, &received, conf.Timeout)
+	//Give stray notifications a moment to show up before comparing
+	time.Sleep(50 * time.Millisecond)
+	closeClients(clients)
+
+	var problems []string
+	for _, c := range clients {
+		if problem := c.check(expected[c.userId]); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		if len(problems) > 5 {
+			problems = append(problems[:5], fmt.Sprintf("and %d more clients", len(problems)-5))
+		}
+		return nil, errors.New("NOTIFICATIONS MISSING OR OUT OF ORDER: " + strings.Join(problems, "; "))
+	}
+	return &Result{Events: conf.TotalEvents, Notifications: total, Elapsed: time.Since(start)}, nil
+}
+
+//Waits until done is closed or no notification was received for timeout
+func waitForClients(done <-chan struct{}, received *int64, timeout time.Duration) {
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	last := atomic.LoadInt64(received)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := atomic.LoadInt64(received)
+			if n == last {
+				return
+			}
+			last = n
+		}
+	}
+}
+
+//client is a single connected user keeping track of everything it receives
+//Like a real client it reconnects and resumes after its last notification when
+//the server disconnects it, e.g. for falling behind
+type client struct {
+	userId     int
+	addr       string
+	connection net.Conn
+	mutex      sync.Mutex
+	received   *stream
+	lastSeq    int
+	//First notification received after one with a later sequence number
+	outOfOrder string
+	stopping   bool
+	closed     chan struct{}
+}
+
+//Connects and registers a user, wg is released once it has received want notifications
+//Every notification received is counted in received
+func connectClient(addr string, userId int, want int, wg *sync.WaitGroup, received *int64) (*client, error) {
+	c := &client{userId: userId, addr: addr, received: newStream(), closed: make(chan struct{})}
+	if err := c.connect(strconv.Itoa(userId)); err != nil {
+		return nil, err
+	}
+	wg.Add(1)
+	go c.read(want, wg, received)
+	return c, nil
+}
+
+//Dials the server and registers with id, either the bare user ID or "userId|lastSeenSequence"
+func (c *client) connect(id string) error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, id+"\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopping {
+		conn.Close()
+		return errors.New("client stopped")
+	}
+	c.connection = conn
+	return nil
+}
+
+//Reconnects after the server closed the connection, false once the run is over
+func (c *client) reconnect() bool {
+	c.mutex.Lock()
+	stopping := c.stopping
+	id := strconv.Itoa(c.userId) + "|" + strconv.Itoa(c.lastSeq)
+	c.mutex.Unlock()
+	return !stopping && c.connect(id) == nil
+}
+
+//Closes the connection for good and waits for the reader to return
+func (c *client) close() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.connection.Close()
+	c.mutex.Unlock()
+	<-c.closed
+}
+
+func (c *client) read(want int, wg *sync.WaitGroup, received *int64) {
+	defer close(c.closed)
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			wg.Done()
+		}
+	}
+	defer release()
+	if want == 0 {
+		release()
+	}
+	r := bufio.NewReader(c.connection)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if !c.reconnect() {
+				return
+			}
+			r = bufio.NewReader(c.connection)
+			continue
+		}
+		line = strings.TrimRight(line, "\r\n")
+		seq := atoi(strings.SplitN(line, "|", 2)[0])
+		c.mutex.Lock()
+		if seq <= c.lastSeq && c.outOfOrder == "" {
+			c.outOfOrder = line
+		}
+		c.lastSeq = seq
+		c.received.add(line)
+		n := c.received.count
+		c.mutex.Unlock()
+		atomic.AddInt64(received, 1)
+		if n >= want {
+			release()
+		}
+	}
+}
+
+//Compares what the client received with what it should have received
+func (c *client) check(want *stream) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	got := c.received
+	switch {
+	case c.outOfOrder != "":
+		return fmt.Sprintf("user %d got %s out of order", c.userId, c.outOfOrder)
+	case got.count < want.count:
+		return fmt.Sprintf("user %d missing %d of %d notifications after %q", c.userId, want.count-got.count, want.count, got.last)
+	case got.count > want.count:
+		return fmt.Sprintf("user %d got %d unexpected notifications, the last was %s", c.userId, got.count-want.count, got.last)
+	case got.hash.Sum64() != want.hash.Sum64():
+		return fmt.Sprintf("user %d got %d notifications but not the expected ones", c.userId, got.count)
+	}
+	return ""
+}
+
+func closeClients(clients []*client) {
+	for _, c := range clients {
+		if c != nil {
+			c.close()
+		}
+	}
+}
+
+//Sends the generated events, shuffled within batches like Shuffle does
+func sendEvents(addr string, g *generator, maxBatch int, seed int64) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	r := rand.New(rand.NewSource(seed))
+	var batch []string
+	for {
+		size := 1
+		if maxBatch >= 2 {
+			size += r.Intn(maxBatch)
+		}
+		batch = batch[:0]
+		for len(batch) < size {
+			e, ok := g.event()
+			if !ok {
+				break
+			}
+			batch = append(batch, e)
+		}
+		if len(batch) == 0 {
+			return w.Flush()
+		}
+		if maxBatch >= 2 {
+			shuffleBatch(r, batch)
+		}
+		for _, e := range batch {
+			if _, err := w.WriteString(e + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func pickType(r *rand.Rand) string {
+	n := r.Intn(100)
+	for _, m := range eventMix {
+		if n < m.weight {
+			return m.eventType
+		}
+		n -= m.weight
+	}
+	return "B"
+}
+
+func randomPair(r *rand.Rand, users int) (string, string) {
+	from := 1 + r.Intn(users)
+	to := 1 + r.Intn(users)
+	for users > 1 && to == from {
+		to = 1 + r.Intn(users)
+	}
+	return strconv.Itoa(from), strconv.Itoa(to)
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,92 @@
+package simulator_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/simulator"
+)
+
+func TestSimulator_GenerateIsReproducible(t *testing.T) {
+	conf := simulator.DefaultConfig()
+	conf.TotalEvents = 1000
+	first := simulator.Generate(conf)
+	if !reflect.DeepEqual(first, simulator.Generate(conf)) {
+		t.Error("Same seed should generate the same events")
+	}
+	conf.Seed++
+	if reflect.DeepEqual(first, simulator.Generate(conf)) {
+		t.Error("Different seeds should generate different events")
+	}
+}
+
+func TestSimulator_ShuffleKeepsEvents(t *testing.T) {
+	conf := simulator.DefaultConfig()
+	conf.TotalEvents = 1000
+	events := simulator.Generate(conf)
+	shuffled := simulator.Shuffle(events, 10, 1)
+	if reflect.DeepEqual(events, shuffled) {
+		t.Error("Events should have been shuffled")
+	}
+	sort.Strings(events)
+	sort.Strings(shuffled)
+	if !reflect.DeepEqual(events, shuffled) {
+		t.Error("Shuffling shouldn't add or lose events")
+	}
+}
+
+func TestSimulator_Expected(t *testing.T) {
+	events := []string{"1|F|1|2", "2|S|2", "3|U|1|2", "4|S|2", "5|P|2|3", "6|B"}
+	expected := simulator.Expected(events, 3)
+	want := map[int][]string{
+		1: {"2|S|2", "6|B"},
+		2: {"1|F|1|2", "6|B"},
+		3: {"5|P|2|3", "6|B"},
+	}
+	if !reflect.DeepEqual(expected, want) {
+		t.Error("Unexpected notifications ", expected)
+	}
+}
+
+func TestSimulator_RunReportsMissingNotifications(t *testing.T) {
+	es, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer es.Close()
+	us, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer us.Close()
+	//A server that accepts everything and delivers nothing
+	go func() {
+		for {
+			conn, err := es.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := us.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	conf := simulator.DefaultConfig()
+	conf.EventAddr = es.Addr().String()
+	conf.UserAddr = us.Addr().String()
+	conf.TotalEvents = 100
+	conf.Users = 3
+	conf.SettleTime = 0
+	conf.Timeout = 100 * time.Millisecond
+	_, err := simulator.Run(conf)
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Error("Expected missing notifications to be reported, got ", err)
+	}
+}
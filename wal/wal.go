@@ -0,0 +1,342 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Write-ahead log used by the server to persist incoming events
+//Records are appended to numbered segment files inside a directory,
+//each record is framed as [length uint32][crc32 uint32][payload]
+//A torn record at the tail of the newest segment (crash mid write) is
+//truncated on Open, corruption anywhere else is reported as an error
+//A record never spans segments, so a length larger than a segment can hold is torn as well
+
+const (
+	//DefaultSegmentBytes is used when Options.SegmentBytes is not set
+	DefaultSegmentBytes = 64 << 20
+	segmentSuffix       = ".wal"
+	headerSize          = 8
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	//ErrCorrupt is returned by Replay when a record fails its checksum
+	ErrCorrupt = errors.New("wal: corrupt record")
+	//ErrClosed is returned when appending to a closed Log
+	ErrClosed = errors.New("wal: log closed")
+	//ErrTooLarge is returned when appending a record that doesn't fit into a segment
+	ErrTooLarge = errors.New("wal: record larger than a segment")
+)
+
+//Options control segment size and durability of appends
+//With Sync set every Append is followed by an fsync of the segment
+type Options struct {
+	SegmentBytes int64
+	Sync         bool
+}
+
+//Log is a segmented append-only log, safe for concurrent appends
+type Log struct {
+	mutex    sync.Mutex
+	dir      string
+	opts     Options
+	segments []int
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	closed   bool
+	//Held while compacting, only Compact removes segments
+	compacting sync.Mutex
+}
+
+//Opens (or creates) the log stored in dir
+//The newest segment is checked and any torn tail record is cut off
+//so new appends always follow the last valid record
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, opts: opts, segments: segments}
+	if len(segments) == 0 {
+		if err := l.openSegment(1); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	last := segments[len(segments)-1]
+	valid, err := validLength(l.segmentPath(last), l.maxRecord())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(l.segmentPath(last), valid); err != nil {
+		return nil, err
+	}
+	l.segments = segments[:len(segments)-1]
+	if err := l.openSegment(last); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//Appends a single record to the log, rolling over to a new segment
+//when the current one would grow past Options.SegmentBytes
+//The record is flushed to the OS (and fsynced with Options.Sync) before returning
+func (l *Log) Append(data []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	recordSize := int64(headerSize + len(data))
+	if recordSize > l.opts.SegmentBytes {
+		return ErrTooLarge
+	}
+	if l.size > 0 && l.size+recordSize > l.opts.SegmentBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(data, crcTable))
+	if _, err := l.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := l.writer.Write(data); err != nil {
+		return err
+	}
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	l.size += recordSize
+	if l.opts.Sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+//Reads every record of every segment in order and hands it to fn
+//Replay stops at the first error returned by fn
+func (l *Log) Replay(fn func([]byte) error) error {
+	l.mutex.Lock()
+	segments := append([]int{}, l.segments...)
+	l.mutex.Unlock()
+	for _, s := range segments {
+		if err := replaySegment(l.segmentPath(s), l.maxRecord(), fn); err != nil {
+			return fmt.Errorf("wal: segment %d: %v", s, err)
+		}
+	}
+	return nil
+}
+
+//Deletes sealed segments, oldest first, for as long as every record in them is obsolete
+//The segment being appended to is never deleted
+//Returns the number of segments deleted
+func (l *Log) Compact(obsolete func([]byte) bool) (int, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return 0, ErrClosed
+	}
+	sealed := append([]int{}, l.segments[:len(l.segments)-1]...)
+	l.mutex.Unlock()
+	removed := 0
+	for _, s := range sealed {
+		stale := true
+		err := replaySegment(l.segmentPath(s), l.maxRecord(), func(record []byte) error {
+			if !obsolete(record) {
+				stale = false
+				return errLive
+			}
+			return nil
+		})
+		if err != nil && err != errLive {
+			return removed, fmt.Errorf("wal: segment %d: %v", s, err)
+		}
+		if !stale {
+			break
+		}
+		//Forget the segment before deleting it so a replay never opens a deleted file
+		l.mutex.Lock()
+		l.segments = l.segments[1:]
+		l.mutex.Unlock()
+		if err := os.Remove(l.segmentPath(s)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+//Stops a compaction scan at the first record still needed
+var errLive = errors.New("wal: live record")
+
+//Largest record payload a segment can hold
+func (l *Log) maxRecord() int64 {
+	return l.opts.SegmentBytes - headerSize
+}
+
+//Returns the number of segment files currently making up the log
+func (l *Log) Segments() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.segments)
+}
+
+//Flushes and closes the active segment
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func (l *Log) segmentPath(n int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%08d%s", n, segmentSuffix))
+}
+
+//Opens segment n for appending and makes it the active segment
+func (l *Log) openSegment(n int) error {
+	f, err := os.OpenFile(l.segmentPath(n), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	l.size = info.Size()
+	l.segments = append(l.segments, n)
+	return nil
+}
+
+//Seals the active segment and starts the next one
+func (l *Log) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	return l.openSegment(l.segments[len(l.segments)-1] + 1)
+}
+
+//Returns the sorted segment numbers found in dir
+func listSegments(dir string) ([]int, error) {
+	entries, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(e), segmentSuffix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+//Reads one record of at most max bytes from r, io.EOF is only returned on a clean record boundary
+func readRecord(r *bufio.Reader, max int64) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrCorrupt
+		}
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > max {
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrCorrupt
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+func replaySegment(path string, max int64, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		data, err := readRecord(r, max)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
+//Returns the length of the valid prefix of the segment at path
+func validLength(path string, max int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		data, err := readRecord(r, max)
+		if err == io.EOF || err == ErrCorrupt {
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		valid += int64(headerSize + len(data))
+	}
+}
@@ -0,0 +1,156 @@
+package wal_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sahilahmadlone/MessagingSocketServer/wal"
+)
+
+func replayAll(t *testing.T, l *wal.Log) []string {
+	var records []string
+	err := l.Replay(func(r []byte) error {
+		records = append(records, string(r))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestWal_AppendAndReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	l, err := wal.Open(dir, wal.Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := l.Append([]byte(strconv.Itoa(i) + "|B")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	if l.Segments() < 2 {
+		t.Error("Log should have rotated segments ", l.Segments())
+	}
+
+	l, err = wal.Open(dir, wal.Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	records := replayAll(t, l)
+	if len(records) != 20 || records[0] != "0|B" || records[19] != "19|B" {
+		t.Error("Replayed records don't match appended records ", records)
+	}
+}
+
+func TestWal_TornTailIsTruncated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	l, _ := wal.Open(dir, wal.Options{})
+	l.Append([]byte("1|B"))
+	l.Append([]byte("2|B"))
+	l.Close()
+
+	segment := filepath.Join(dir, "00000001.wal")
+	info, _ := os.Stat(segment)
+	os.Truncate(segment, info.Size()-2)
+
+	l, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append([]byte("3|B"))
+	records := replayAll(t, l)
+	l.Close()
+	if len(records) != 2 || records[0] != "1|B" || records[1] != "3|B" {
+		t.Error("Torn record should have been dropped ", records)
+	}
+}
+
+func TestWal_CorruptRecordFailsReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	l, _ := wal.Open(dir, wal.Options{SegmentBytes: 16})
+	l.Append([]byte("1|B"))
+	l.Append([]byte("2|B"))
+	l.Close()
+
+	segment := filepath.Join(dir, "00000001.wal")
+	data, _ := ioutil.ReadFile(segment)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(segment, data, 0644)
+
+	l, err := wal.Open(dir, wal.Options{SegmentBytes: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Replay(func([]byte) error { return nil }); err == nil {
+		t.Error("Replay of a corrupt sealed segment should fail")
+	}
+}
+
+func TestWal_OversizedLengthIsTorn(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	l, _ := wal.Open(dir, wal.Options{SegmentBytes: 64})
+	l.Append([]byte("1|B"))
+	l.Close()
+
+	//A length header claiming 4GB must not be allocated
+	segment := filepath.Join(dir, "00000001.wal")
+	f, _ := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	f.Close()
+
+	l, err := wal.Open(dir, wal.Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	records := replayAll(t, l)
+	if len(records) != 1 || records[0] != "1|B" {
+		t.Error("Oversized record should have been dropped as a torn tail ", records)
+	}
+	if err := l.Append(make([]byte, 64)); err != wal.ErrTooLarge {
+		t.Error("Append of a record larger than a segment should fail ", err)
+	}
+}
+
+func TestWal_CompactDeletesObsoleteSegments(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	l, _ := wal.Open(dir, wal.Options{SegmentBytes: 16})
+	defer l.Close()
+	for i := 1; i <= 6; i++ {
+		l.Append([]byte(strconv.Itoa(i) + "|B"))
+	}
+	if l.Segments() != 6 {
+		t.Fatal("Every record should have its own segment ", l.Segments())
+	}
+	removed, err := l.Compact(func(r []byte) bool {
+		seq, _ := strconv.Atoi(string(r[:1]))
+		return seq != 3 && seq < 6
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || l.Segments() != 4 {
+		t.Error("Compaction should stop at the first live record ", removed, l.Segments())
+	}
+	removed, _ = l.Compact(func([]byte) bool { return true })
+	if removed != 3 || l.Segments() != 1 {
+		t.Error("Compaction should never delete the active segment ", removed, l.Segments())
+	}
+	records := replayAll(t, l)
+	if len(records) != 1 || records[0] != "6|B" {
+		t.Error("Only the active segment should be replayed ", records)
+	}
+}